@@ -78,6 +78,30 @@ func GetReplicaServiceEndpointUrl(opts replicaServer.ReplicaOptions) *url.URL {
 	return url
 }
 
+// Implemented by ReplicaOptions that have more than one replica-rust endpoint.
+type alternateEndpointsGetter interface {
+	GetAlternateReplicaRustEndpoints() []string
+}
+
+// This returns the primary replica-rust endpoint followed by any valid alternates, for use with
+// service.ServiceClient.ReplicaServiceEndpoints.
+func GetReplicaServiceEndpointUrls(opts replicaServer.ReplicaOptions) []*url.URL {
+	ret := []*url.URL{GetReplicaServiceEndpointUrl(opts)}
+	getter, ok := opts.(alternateEndpointsGetter)
+	if !ok {
+		return ret
+	}
+	for _, endpointStr := range getter.GetAlternateReplicaRustEndpoints() {
+		url, err := url.Parse(endpointStr)
+		if err != nil {
+			log.Errorf("parsing alternate replica rust endpoint %q: %v", endpointStr, err)
+			continue
+		}
+		ret = append(ret, url)
+	}
+	return ret
+}
+
 type ReplicaOptionsRoot struct {
 	// This is the default.
 	ReplicaOptions `mapstructure:",squash"`
@@ -103,14 +127,19 @@ type ReplicaOptions struct {
 	StaticPeerAddrs []string
 	// Merged with the webseed URLs when the metadata and data buckets are merged.
 	MetadataBaseUrls []string
-	// The replica-rust endpoint to use. There's only one because object uploads and ownership are
-	// fixed to a specific bucket, and replica-rust endpoints are 1:1 with a bucket.
+	// The replica-rust endpoint to use. Object uploads and ownership are fixed to a specific bucket,
+	// and replica-rust deployments are 1:1 with a bucket.
 	ReplicaRustEndpoint string
+	// Other routes to the same replica-rust deployment as ReplicaRustEndpoint, in order of
+	// preference. Requests fail over to these.
+	AlternateReplicaRustEndpoints []string
 	// A set of info hashes (20 bytes, hex-encoded) to which proxies should announce themselves.
 	ProxyAnnounceTargets []string
 	// A set of info hashes where p2p-proxy peers can be found.
 	ProxyPeerInfoHashes []string
 	CustomCA            string
+	// Restricts what clients upload.
+	UploadPolicy replicaServer.UploadPolicy
 }
 
 func (ro *ReplicaOptions) GetWebseedBaseUrls() []string {
@@ -133,10 +162,18 @@ func (ro *ReplicaOptions) GetReplicaRustEndpoint() string {
 	return ro.ReplicaRustEndpoint
 }
 
+func (ro *ReplicaOptions) GetAlternateReplicaRustEndpoints() []string {
+	return ro.AlternateReplicaRustEndpoints
+}
+
 func (ro *ReplicaOptions) GetCustomCA() string {
 	return ro.CustomCA
 }
 
+func (ro *ReplicaOptions) GetUploadPolicy() replicaServer.UploadPolicy {
+	return ro.UploadPolicy
+}
+
 // XXX <11-07-2022, soltzen> DEPREACTED in favor of
 // github.com/getlantern/libp2p
 func (ro *ReplicaOptions) GetProxyAnnounceTargets() []string {
@@ -3,6 +3,7 @@ package replica
 import (
 	"net/url"
 	"path"
+	"strconv"
 
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
@@ -11,13 +12,30 @@ import (
 )
 
 func CreateLink(ih torrent.InfoHash, infoName service.Prefix, filePath []string) string {
+	// Since S3 key is provided, we know that it must be a single-file torrent.
+	return CreateFileLink(ih, infoName, 0, filePath)
+}
+
+// CreateFileLink creates a link to the file at fileIndex in a (possibly multi-file) upload.
+func CreateFileLink(ih torrent.InfoHash, infoName service.Prefix, fileIndex int, filePath []string) string {
 	return metainfo.Magnet{
 		InfoHash:    ih,
 		DisplayName: path.Join(filePath...),
 		Params: url.Values{
 			"xs": {service.ExactSource(infoName)},
-			// Since S3 key is provided, we know that it must be a single-file torrent.
-			"so": {"0"},
+			"so": {strconv.Itoa(fileIndex)},
+		},
+	}.String()
+}
+
+// CreateTorrentLink creates a link to an entire upload. There's no "so" parameter, so it doesn't
+// select any particular file.
+func CreateTorrentLink(ih torrent.InfoHash, infoName service.Prefix, displayName string) string {
+	return metainfo.Magnet{
+		InfoHash:    ih,
+		DisplayName: displayName,
+		Params: url.Values{
+			"xs": {service.ExactSource(infoName)},
 		},
 	}.String()
 }
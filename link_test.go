@@ -49,3 +49,22 @@ func TestS3KeyFromReplicaMagnetOpaqueKey(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualValues(t, "4cfacbd0-811c-4319-9d57-87c484c14814", s3Key.String())
 }
+
+func TestCreateMultiFileLinks(t *testing.T) {
+	var infoHash torrent.InfoHash
+	require.NoError(t, infoHash.FromHexString("deadbeefc0ffeec0ffeedeadbeefc0ffeec0ffee"))
+	upload := service.NewUuidPrefix()
+
+	m, err := metainfo.ParseMagnetUri(CreateFileLink(infoHash, upload, 2, []string{"show", "subs.srt"}))
+	require.NoError(t, err)
+	require.Equal(t, "2", m.Params.Get("so"))
+	require.Equal(t, "show/subs.srt", m.DisplayName)
+
+	m, err = metainfo.ParseMagnetUri(CreateTorrentLink(infoHash, upload, "show"))
+	require.NoError(t, err)
+	require.False(t, m.Params.Has("so"))
+	require.Equal(t, "show", m.DisplayName)
+	var fromLink service.Upload
+	require.NoError(t, fromLink.FromMagnet(m))
+	require.Equal(t, upload, fromLink.Prefix)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/errors"
+	"github.com/kennygrant/sanitize"
+)
+
+// Writes files into an archive as they're read.
+type archiveWriter interface {
+	// Starts a file, which must be written in full before the next is created.
+	Create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (me zipArchiveWriter) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return me.CreateHeader(&zip.FileHeader{
+		Name: name,
+		// Torrents are mostly media that doesn't compress, and storing is fastest for streaming.
+		Method:   zip.Store,
+		Modified: modified,
+	})
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (me tarArchiveWriter) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return me.Writer, me.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modified,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// Reads from a torrent reader until ctx is done.
+type contextTorrentReader struct {
+	ctx context.Context
+	r   torrent.Reader
+}
+
+func (me contextTorrentReader) Read(b []byte) (int, error) {
+	return me.r.ReadContext(me.ctx, b)
+}
+
+// The path of a torrent file within an archive. Every component is sanitized, including directories
+// and names without extensions, and paths that still aren't safe are rejected.
+func archiveEntryName(filePath string) (string, error) {
+	var components []string
+	for _, c := range strings.Split(filePath, "/") {
+		if c == "" || c == "." || c == ".." {
+			continue
+		}
+		c = sanitizeArchiveEntryComponent(c)
+		if c == "" || c == "." || c == ".." {
+			continue
+		}
+		if strings.ContainsAny(c, `/\:`) {
+			return "", errors.New("unsafe archive entry component %q", c)
+		}
+		components = append(components, c)
+	}
+	if len(components) == 0 {
+		return "", errors.New("no archive entry name for %q", filePath)
+	}
+	return strings.Join(components, "/"), nil
+}
+
+// Like sanitizeFileName, but names without extensions are sanitized too.
+func sanitizeArchiveEntryComponent(c string) string {
+	ext := path.Ext(c)
+	base := strings.TrimSuffix(c, ext)
+	if base == "" {
+		// Names like ".hidden" are all extension.
+		return sanitize.BaseName(c)
+	}
+	base = sanitize.BaseName(base)
+	if ext = sanitize.BaseName(strings.TrimPrefix(ext, ".")); ext != "" {
+		base += "." + ext
+	}
+	return base
+}
+
+// Streams every file in the torrent into a zip or tar archive. The files are downloaded in archive
+// order.
+func (me *HttpHandler) handleArchiveDownload(rw InstrumentedResponseWriter, r *http.Request) error {
+	format := r.URL.Query().Get("format")
+	rw.Set("archive_format", format)
+	var contentType string
+	switch format {
+	case "zip":
+		contentType = "application/zip"
+	case "tar":
+		contentType = "application/x-tar"
+	default:
+		return handlerError{http.StatusBadRequest, errors.New("unsupported archive format %q", format)}
+	}
+	m, err := metainfo.ParseMagnetUri(r.URL.Query().Get("link"))
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+	}
+	rw.Set("info_hash", m.InfoHash)
+
+	t, _, release := me.confluence.GetTorrent(m.InfoHash)
+	defer release()
+	gc := me.GlobalConfig()
+	if m.DisplayName != "" {
+		t.SetDisplayName(m.DisplayName)
+	}
+	addReplicaPeers(gc, t)
+	err = me.waitForTorrentInfo(r.Context(), t, metainfoUrls(m, gc))
+	if err != nil {
+		return err
+	}
+
+	filename := sanitizeFileName(firstNonEmptyString(m.DisplayName, t.Name())) + "." + format
+	rw.Set("download_filename", filename)
+	if me.OnRequestReceived != nil {
+		me.OnRequestReceived("download", "."+format)
+	}
+	files := t.Files()
+	// Want everything, but pieces are requested in order, and whatever is being read first.
+	for _, f := range files {
+		f.SetPriority(torrent.PiecePriorityNormal)
+	}
+	defer func() {
+		// Don't keep downloading if the request is cancelled. Already completed pieces are kept.
+		for _, f := range files {
+			f.SetPriority(torrent.PiecePriorityNone)
+		}
+	}()
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name, err := archiveEntryName(f.Path())
+		if err != nil {
+			return handlerError{http.StatusUnprocessableEntity, err}
+		}
+		names = append(names, name)
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.QueryEscape(filename))
+	var aw archiveWriter
+	if format == "zip" {
+		aw = zipArchiveWriter{zip.NewWriter(rw)}
+	} else {
+		aw = tarArchiveWriter{tar.NewWriter(rw)}
+	}
+	modified := time.Now()
+	if creationDate := t.Metainfo().CreationDate; creationDate != 0 {
+		modified = time.Unix(creationDate, 0)
+	}
+	// Headers have gone out once anything is written, so errors can't change the response.
+	for i, f := range files {
+		if i+1 < len(files) {
+			files[i+1].SetPriority(torrent.PiecePriorityHigh)
+		}
+		err = writeArchiveFile(r.Context(), aw, f, names[i], modified)
+		if err != nil {
+			return encoderWriterError{errors.New("writing %q to archive: %v", f.Path(), err)}
+		}
+	}
+	err = aw.Close()
+	if err != nil {
+		return encoderWriterError{errors.New("closing archive: %v", err)}
+	}
+	return nil
+}
+
+func writeArchiveFile(ctx context.Context, aw archiveWriter, f *torrent.File, name string, modified time.Time) error {
+	w, err := aw.Create(name, f.Length(), modified)
+	if err != nil {
+		return err
+	}
+	reader := f.NewReader()
+	defer reader.Close()
+	// Torrent readers can read past the end of the file they're for.
+	_, err = io.CopyN(w, contextTorrentReader{ctx, reader}, f.Length())
+	return err
+}
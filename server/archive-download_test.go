@@ -0,0 +1,103 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestArchiveDownload(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+	output, err := srv.ServiceClient().UploadFiles("show", []service.MultiUploadFile{
+		{Path: []string{"show", "episode.mp4"}, Reader: strings.NewReader("episode content")},
+		{Path: []string{"show", "notes.txt"}, Reader: strings.NewReader("notes content")},
+	}, service.UploadOptions{})
+	require.NoError(t, err)
+	download := func(format string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		query := url.Values{"link": {*output.Link}, "format": {format}}.Encode()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download?"+query, nil))
+		return w
+	}
+	want := map[string]string{
+		"show/episode.mp4": "episode content",
+		"show/notes.txt":   "notes content",
+	}
+	// Entries are under the torrent name, which differs by layout.
+	stripName := func(name string) string {
+		_, name, _ = strings.Cut(name, "/")
+		return name
+	}
+
+	w := download("zip")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), ".zip")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		got[stripName(f.Name)] = string(b)
+	}
+	assert.Equal(t, want, got)
+
+	w = download("tar")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+	tr := tar.NewReader(w.Body)
+	got = make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		got[stripName(hdr.Name)] = string(b)
+	}
+	assert.Equal(t, want, got)
+
+	assert.Equal(t, http.StatusBadRequest, download("rar").Code)
+}
+
+func TestArchiveEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		filePath string
+		want     string
+	}{
+		{"show/episode.mp4", "show/episode.mp4"},
+		{`dir\with:colon/README`, "dirwith-colon/README"},
+		{`extensionless\name`, "extensionlessname"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"./a/./b.txt", "a/b.txt"},
+	} {
+		got, err := archiveEntryName(tc.filePath)
+		if assert.NoError(t, err, tc.filePath) {
+			assert.Equal(t, tc.want, got, tc.filePath)
+		}
+	}
+	for _, filePath := range []string{"", "..", "./.."} {
+		_, err := archiveEntryName(filePath)
+		assert.Error(t, err, filePath)
+	}
+}
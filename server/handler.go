@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
@@ -18,6 +21,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/chansync"
@@ -27,7 +31,6 @@ import (
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/storage"
-	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	metascrubber "github.com/getlantern/meta-scrubber"
@@ -35,6 +38,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	"github.com/kennygrant/sanitize"
+	"golang.org/x/time/rate"
 
 	"github.com/getlantern/replica/service"
 )
@@ -54,9 +58,28 @@ type HttpHandler struct {
 	router      *mux.Router
 	searchProxy http.Handler
 	NewHttpHandlerInput
-	uploadStorage  storage.ClientImplCloser
-	defaultStorage storage.ClientImplCloser
-	closed         chansync.SetOnce
+	uploadStorage storage.ClientImplCloser
+	viewStorage   storage.ClientImplCloser
+	// The view storage, if it's a sqlite cache.
+	storageCache *storageCache
+	closed       chansync.SetOnce
+	closeOnce    sync.Once
+	// Set when Shutdown starts. New requests and queued uploads aren't started after.
+	shuttingDown chansync.SetOnce
+	// In-flight requests, and goroutines that Shutdown waits for.
+	requests       activities
+	background     activities
+	uploadProgress uploadProgressTracker
+	uploadQueue    *uploadQueue
+	// Summarized useful data received from peers.
+	peerData *peerDataMetrics
+	// Counters exposed by /metrics.
+	metrics *metricsRegistry
+	// Pinned torrents, kept for offline use.
+	library *library
+	// Shared by the torrent client and uploads to the Replica service.
+	uploadRateLimiter   *rate.Limiter
+	downloadRateLimiter *rate.Limiter
 }
 
 func getMetainfoUrls(ro ReplicaOptions, prefix string) (ret []string) {
@@ -123,6 +146,37 @@ type NewHttpHandlerInput struct {
 	ProcessCORSHeaders func(responseHeaders http.Header, r *http.Request) bool
 	// Instruments the given ResponseWriter for tracking metrics under the given label
 	InstrumentResponseWriter func(w http.ResponseWriter, label string) InstrumentedResponseWriter
+	// Secret used to encrypt upload admin tokens at rest. Required unless UploadTokenStore is set.
+	// Tokens are only protected from someone holding the device if this isn't kept on it in the
+	// clear, like when it comes from the platform keystore.
+	UploadTokenSecret []byte
+	// Where upload admin tokens are kept. Defaults to the uploads directory, encrypted with
+	// UploadTokenSecret.
+	UploadTokenStore UploadTokenStore
+	// Bytes per second sent and received by the torrent client. The upload limit also applies to
+	// uploads to the Replica service, unless ReplicaServiceClient has its own limiter. Zero is
+	// unlimited. See HttpHandler.SetRateLimits.
+	UploadRateLimit   int64
+	DownloadRateLimit int64
+	// Restricts what can be uploaded. If nil, the policy from GlobalConfig is used, if it has one.
+	UploadPolicy *UploadPolicy
+	// How long views and downloads wait for a torrent's info before failing. Defaults to a minute.
+	MetadataTimeout time.Duration
+	// Bytes of torrent data cached for views and downloads, which is kept across restarts. Defaults
+	// to 5 GiB. Less than zero is unlimited. Only applies to the default view storage.
+	StorageCacheCapacity int64
+	// Torrent storage for views and downloads, uploads, and the library respectively. By default,
+	// views use a sqlite cache, uploads use FileStorage, and the library uses FileByInfoHashStorage.
+	// Uploads stored locally are only found by storage with the FileStorage layout, and removing
+	// from the library only deletes data for FileByInfoHashStorage.
+	ViewStorage    StorageFactory
+	UploadStorage  StorageFactory
+	LibraryStorage StorageFactory
+	// How many times a queued upload is tried before it's marked failed. Uploads are tried for as long
+	// as the service can't be reached, without counting against this. Defaults to 40.
+	MaxUploadQueueAttempts int
+	// Serve Prometheus metrics at /metrics.
+	ServeMetrics bool
 }
 
 // Returns candidate cache directories in order of preference.
@@ -168,6 +222,29 @@ func NewHTTPHandler(
 	if err != nil {
 		return nil, errors.New("mkdir uploadsDir %v: %v", uploadsDir, err)
 	}
+	if input.UploadTokenStore == nil {
+		if len(input.UploadTokenSecret) == 0 {
+			return nil, errors.New("an UploadTokenSecret or UploadTokenStore is required")
+		}
+		store, err := NewUploadTokenStore(uploadsDir, input.UploadTokenSecret)
+		if err != nil {
+			return nil, errors.New("creating upload token store: %v", err)
+		}
+		input.UploadTokenStore = store
+	}
+	if input.ReplicaServiceClient.ResumableUploadsDir == "" {
+		// Keep state for interrupted uploads next to the uploads so they can resume after restarts.
+		input.ReplicaServiceClient.ResumableUploadsDir = filepath.Join(input.RootUploadsDir, "replica", "resumable-uploads")
+	}
+	uploadRateLimiter := newRateLimiter(input.UploadRateLimit)
+	downloadRateLimiter := newRateLimiter(input.DownloadRateLimit)
+	if input.ReplicaServiceClient.UploadRateLimiter == nil {
+		input.ReplicaServiceClient.UploadRateLimiter = uploadRateLimiter
+	}
+	if input.ReplicaServiceClient.EndpointHealth == nil {
+		// Shared by uploads, deletes and the search proxy.
+		input.ReplicaServiceClient.EndpointHealth = &service.EndpointHealth{}
+	}
 	replicaDataDir := filepath.Join(replicaCacheDir, "data")
 	err = os.MkdirAll(replicaDataDir, 0o700)
 	if err != nil {
@@ -189,34 +266,47 @@ func NewHTTPHandler(
 	} else {
 		cfg.Seed = true
 	}
+	cfg.UploadRateLimiter = uploadRateLimiter
+	cfg.DownloadRateLimiter = downloadRateLimiter
 	cfg.HeaderObfuscationPolicy.Preferred = true
 	cfg.HeaderObfuscationPolicy.RequirePreferred = true
 	// cfg.Debug = true
 	cfg.Logger = analog.Default.WithContextText(handlerLogPrefix + ".torrent-client")
 
-	var opts sqliteStorage.NewDirectStorageOpts
-	opts.Path = filepath.Join(replicaCacheDir, "storage-cache.db")
-	os.Remove(opts.Path)
-	opts.Capacity = 5 << 30
-	defaultStorage, err := sqliteStorage.NewDirectStorage(opts)
+	var viewStorage storage.ClientImplCloser
+	if input.ViewStorage == nil {
+		// Kept where it always has been.
+		viewStorage, err = SqliteStorage(input.StorageCacheCapacity)(replicaCacheDir)
+	} else {
+		viewStorage, err = newRoleStorage(input.ViewStorage, nil, filepath.Join(replicaCacheDir, "view-storage"))
+	}
+	if err != nil {
+		return nil, errors.New("creating view storage: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			viewStorage.Close()
+		}
+	}()
+	cfg.DefaultStorage = viewStorage
+	// I think the standard file-storage implementation is sufficient here because we guarantee
+	// unique info name/prefixes for uploads (which the default file implementation does not).
+	// There's another implementation that injects the infohash as a prefix to ensure uniqueness
+	// of final file names.
+	uploadStorage, err := newRoleStorage(input.UploadStorage, FileStorage(), replicaDataDir)
 	if err != nil {
-		return nil, errors.New("creating torrent storage cache with opts %+v: %v", opts, err)
+		return nil, errors.New("creating upload storage: %v", err)
 	}
 	defer func() {
 		if err != nil {
-			defaultStorage.Close()
+			uploadStorage.Close()
 		}
 	}()
-	cfg.DefaultStorage = defaultStorage
 
+	peerData := newPeerDataMetrics()
 	cfg.Callbacks.ReceivedUsefulData = append(cfg.Callbacks.ReceivedUsefulData,
 		func(event torrent.ReceivedUsefulDataEvent) {
-			op := ops.Begin("replica_torrent_peer_sent_data")
-			op.Set("remote_addr", event.Peer.RemoteAddr.String())
-			op.Set("remote_network", event.Peer.Network)
-			op.Set("useful_bytes_count", float64(len(event.Message.Piece)))
-			op.Set("info_hash", event.Peer.Torrent().InfoHash().HexString())
-			op.End()
+			peerData.receivedUsefulData(event)
 			log.Tracef("reported %v bytes from %v over %v",
 				len(event.Message.Piece),
 				event.Peer.RemoteAddr.String(),
@@ -252,14 +342,17 @@ func NewHTTPHandler(
 		searchProxy: http.StripPrefix("/search", proxyHandler(
 			input,
 			nil)),
-		// I think the standard file-storage implementation is sufficient here because we guarantee
-		// unique info name/prefixes for uploads (which the default file implementation does not).
-		// There's another implementation that injects the infohash as a prefix to ensure uniqueness
-		// of final file names.
-		uploadStorage:       storage.NewFile(replicaDataDir),
-		defaultStorage:      defaultStorage,
+		uploadStorage:       uploadStorage,
+		viewStorage:         viewStorage,
 		NewHttpHandlerInput: input,
+		uploadRateLimiter:   uploadRateLimiter,
+		downloadRateLimiter: downloadRateLimiter,
+		peerData:            peerData,
+		metrics:             newMetricsRegistry(),
 	}
+	handler.storageCache, _ = viewStorage.(*storageCache)
+	// Library items wait on views of their torrents with this.
+	handler.confluence.OnTorrentGrace = handler.onTorrentGrace
 
 	// XXX <03-02-22, soltzen> See
 	// https://github.com/getlantern/lantern-internal/issues/5226 for more
@@ -288,11 +381,30 @@ func NewHTTPHandler(
 	handler.router.HandleFunc("/thumbnail", handler.wrapHandlerError("replica_thumbnail", handler.handleMetadata("thumbnail")))
 	handler.router.HandleFunc("/duration", handler.wrapHandlerError("replica_duration", handler.handleMetadata("duration")))
 	handler.router.HandleFunc("/upload", handler.wrapHandlerError("replica_upload", handler.handleUpload))
+	handler.router.HandleFunc("/upload/edit", handler.wrapHandlerError("replica_upload_edit", handler.handleUploadEdit))
+	handler.router.HandleFunc("/upload/progress", handler.wrapHandlerError("replica_upload_progress", handler.handleUploadProgress))
 	handler.router.HandleFunc("/uploads", handler.wrapHandlerError("replica_uploads", handler.handleUploads))
+	handler.router.HandleFunc("/uploads/export", handler.wrapHandlerError("replica_uploads_export", handler.handleUploadsExport))
+	handler.router.HandleFunc("/uploads/import", handler.wrapHandlerError("replica_uploads_import", handler.handleUploadsImport))
+	handler.router.HandleFunc("/uploads/queue", handler.wrapHandlerError("replica_upload_queue", handler.handleUploadQueue))
+	handler.router.HandleFunc("/uploads/queue/cancel", handler.wrapHandlerError("replica_upload_queue_cancel", handler.handleUploadQueueCancel))
+	handler.router.HandleFunc("/uploads/queue/retry", handler.wrapHandlerError("replica_upload_queue_retry", handler.handleUploadQueueRetry))
+	handler.router.HandleFunc("/settings", handler.wrapHandlerError("replica_settings", handler.handleSettings))
 	handler.router.HandleFunc("/view", handler.wrapHandlerError("replica_view", handler.handleView))
+	handler.router.HandleFunc("/library", handler.wrapHandlerError("replica_library", handler.handleLibrary))
+	handler.router.HandleFunc("/library/remove", handler.wrapHandlerError("replica_library_remove", handler.handleLibraryRemove))
+	handler.router.HandleFunc("/files", handler.wrapHandlerError("replica_files", handler.handleFiles))
+	handler.router.HandleFunc("/torrent_status", handler.wrapHandlerError("replica_torrent_status", handler.handleTorrentStatus))
+	handler.router.HandleFunc("/cache", handler.wrapHandlerError("replica_cache", handler.handleStorageCache))
+	handler.router.HandleFunc("/cache/torrents", handler.wrapHandlerError("replica_cache_torrents", handler.handleStorageCacheTorrents))
+	handler.router.HandleFunc("/cache/purge", handler.wrapHandlerError("replica_cache_purge", handler.handleStorageCachePurge))
+	handler.router.HandleFunc("/cache/evict", handler.wrapHandlerError("replica_cache_evict", handler.handleStorageCacheEvict))
 	handler.router.HandleFunc("/download", handler.wrapHandlerError("replica_view", handler.handleDownload))
 	handler.router.HandleFunc("/delete", handler.wrapHandlerError("replica_delete", handler.handleDelete))
 	handler.router.HandleFunc("/object_info", handler.wrapHandlerError("replica_object_info", handler.handleObjectInfo))
+	if input.ServeMetrics {
+		handler.router.HandleFunc("/metrics", handler.wrapHandlerError("replica_metrics_scrape", handler.handleMetrics))
+	}
 	handler.router.HandleFunc("/debug/dht", func(w http.ResponseWriter, r *http.Request) {
 		for _, ds := range torrentClient.DhtServers() {
 			ds.WriteStatus(w)
@@ -320,21 +432,52 @@ func NewHTTPHandler(
 			return nil, errors.New("iterating through uploads: %v", err)
 		}
 	}
-	go handler.metricsExporter()
+	handler.library, err = openLibrary(filepath.Join(replicaCacheDir, "library"), input.LibraryStorage)
+	if err != nil {
+		handler.Close()
+		return nil, errors.New("opening library: %v", err)
+	}
+	// After uploads, which are complete and are left as they are.
+	handler.addLibraryTorrents()
+	handler.uploadQueue, err = openUploadQueue(
+		filepath.Join(input.RootUploadsDir, "replica", "upload-queue"),
+		handler.maxUploadQueueAttempts(),
+	)
+	if err != nil {
+		handler.Close()
+		return nil, errors.New("opening upload queue: %v", err)
+	}
+	handler.background.goActivity("upload queue", handler.runUploadQueue)
+	handler.background.goActivity("metrics exporter", handler.metricsExporter)
+	handler.background.goActivity("peer data exporter", handler.peerDataExporter)
 	return handler, nil
 }
 
 func (me *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("replica server request path: %q", r.URL.Path)
 	me.ProcessCORSHeaders(w.Header(), r)
+	r, done, ok := me.startRequest(r)
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
 	me.router.ServeHTTP(w, r)
 }
 
+// Close closes the handler straight away, cancelling anything in progress. See Shutdown.
 func (me *HttpHandler) Close() {
-	me.torrentClient.Close()
-	me.uploadStorage.Close()
-	me.defaultStorage.Close()
-	me.closed.Set()
+	me.closeOnce.Do(func() {
+		me.closed.Set()
+		me.torrentClient.Close()
+		// After the torrent client, so nothing more comes in.
+		me.peerData.flush()
+		me.uploadStorage.Close()
+		me.viewStorage.Close()
+		if me.library != nil {
+			me.library.storage.Close()
+		}
+	})
 }
 
 // handlerError is just a small wrapper around errors so that we can more easily return them from
@@ -344,6 +487,10 @@ type handlerError struct {
 	error
 }
 
+func (me handlerError) Unwrap() error {
+	return me.error
+}
+
 // encoderError is a small wrapper around error so we know that this is an error
 // during encoding/writing a response and we can avoid trying to re-write headers
 type encoderWriterError struct {
@@ -357,7 +504,10 @@ func (me *HttpHandler) wrapHandlerError(
 	return func(rw http.ResponseWriter, r *http.Request) {
 		w := me.InstrumentResponseWriter(rw, opName)
 		defer w.Finish()
-		if err := handler(w, r); err != nil {
+		start := time.Now()
+		err := handler(w, r)
+		me.metrics.recordRequest(opName, err != nil, time.Since(start))
+		if err != nil {
 			log.Errorf("in %q handler: %v", opName, err)
 			w.FailIf(err)
 
@@ -380,9 +530,19 @@ func (me *HttpHandler) wrapHandlerError(
 				return
 			}
 
-			var statusCode int
+			var (
+				statusCode  int
+				serviceErr  *service.Error
+				metadataErr *metadataTimeoutError
+			)
+			isServiceErr := stdErrors.As(err, &serviceErr)
+			isMetadataErr := stdErrors.As(err, &metadataErr)
 			if e, ok := err.(handlerError); ok {
 				statusCode = e.statusCode
+			} else if isServiceErr {
+				statusCode = serviceErrorStatusCode(serviceErr)
+			} else if isMetadataErr {
+				statusCode = http.StatusGatewayTimeout
 			} else {
 				statusCode = http.StatusInternalServerError
 			}
@@ -391,6 +551,16 @@ func (me *HttpHandler) wrapHandlerError(
 				"statusCode": statusCode,
 				"error":      err.Error(),
 			}
+			if isServiceErr {
+				resp["errorCode"] = serviceErr.Category
+				resp["retryable"] = serviceErr.Retryable
+			} else if stdErrors.Is(err, service.ErrUploadInfoMismatch) {
+				resp["errorCode"] = "upload_info_mismatch"
+			} else if isMetadataErr {
+				resp["errorCode"] = "metadata_timeout"
+				resp["metainfoSources"] = metadataErr.Sources
+				resp["peers"] = metadataErr.Peers
+			}
 
 			var writingEncodingErr error
 			writingEncodingErr = encodeJsonErrorResponse(rw, resp, statusCode)
@@ -402,23 +572,26 @@ func (me *HttpHandler) wrapHandlerError(
 	}
 }
 
-func (me *HttpHandler) writeNewUploadAuthTokenFile(auth string, prefix service.Prefix) error {
-	tokenFilePath := me.uploadTokenPath(prefix)
-	f, err := os.OpenFile(
-		tokenFilePath,
-		os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC,
-		0o440,
-	)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.WriteString(auth)
-	if err != nil {
-		return err
-	}
-	log.Debugf("wrote %q to %q", auth, tokenFilePath)
-	return f.Close()
+// The status we respond with when a request to the Replica service fails.
+func serviceErrorStatusCode(err *service.Error) int {
+	switch err.Category {
+	case service.ErrorCategoryAuthFailure:
+		return http.StatusForbidden
+	case service.ErrorCategoryNotFound:
+		return http.StatusNotFound
+	case service.ErrorCategoryPayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case service.ErrorCategoryRateLimited:
+		return http.StatusTooManyRequests
+	case service.ErrorCategoryUpstreamUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	switch err.StatusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		// Probably something the user gave us.
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
 }
 
 type CountWriter struct {
@@ -430,7 +603,157 @@ func (me *CountWriter) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-func (me *HttpHandler) handleUpload(rw InstrumentedResponseWriter, r *http.Request) error {
+// A file received for upload.
+type uploadSource struct {
+	// The path within the upload. For single file uploads this is just the file name.
+	path []string
+	io.ReadCloser
+	// -1 if unknown.
+	size int64
+}
+
+// Collects the files in an upload request. These are the "file" parts of a multipart form, or the
+// request body if there aren't any.
+func uploadSources(r *http.Request, name string) ([]uploadSource, error) {
+	// There are streaming ways and helpers for temporary files for this if size becomes an issue.
+	formFile, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		log.Debugf("error getting upload file as form file: %v", err)
+		return []uploadSource{{[]string{name}, r.Body, r.ContentLength}}, nil
+	}
+	fileHeaders := r.MultipartForm.File["file"]
+	if len(fileHeaders) == 1 {
+		if name == "" {
+			name = fileHeader.Filename
+		}
+		return []uploadSource{{[]string{name}, formFile, fileHeader.Size}}, nil
+	}
+	formFile.Close()
+	sources := make([]uploadSource, 0, len(fileHeaders))
+	seenPaths := make(map[string]bool, len(fileHeaders))
+	for _, fh := range fileHeaders {
+		filePath, err := multipartFilePath(fh)
+		if err != nil {
+			closeUploadSources(sources)
+			return nil, handlerError{http.StatusBadRequest, err}
+		}
+		key := path.Join(filePath...)
+		if seenPaths[key] {
+			closeUploadSources(sources)
+			return nil, handlerError{http.StatusBadRequest, errors.New("duplicate file path %q", key)}
+		}
+		seenPaths[key] = true
+		f, err := fh.Open()
+		if err != nil {
+			closeUploadSources(sources)
+			return nil, errors.New("opening form file %q: %v", key, err)
+		}
+		sources = append(sources, uploadSource{filePath, f, fh.Size})
+	}
+	return sources, nil
+}
+
+// Gets the name, files and options of an upload request. The sources must be closed.
+func uploadRequest(r *http.Request) (fileName string, sources []uploadSource, uploadOptions service.UploadOptions, err error) {
+	uploadOptions = service.NewUploadOptions(r)
+	if err = uploadOptions.Validate(); err != nil {
+		err = handlerError{http.StatusBadRequest, err}
+		return
+	}
+	fileName = r.URL.Query().Get("name")
+	sources, err = uploadSources(r, fileName)
+	if err != nil {
+		return
+	}
+	if len(sources) > 1 {
+		if fileName == "" {
+			fileName = multiFileUploadName(sources)
+		}
+	} else {
+		fileName = sources[0].path[0]
+	}
+	return
+}
+
+// The total size of the sources before scrubbing, or -1 if it isn't known.
+func uploadSourcesSize(sources []uploadSource) (totalSize int64) {
+	for _, s := range sources {
+		if s.size < 0 {
+			return -1
+		}
+		totalSize += s.size
+	}
+	return
+}
+
+func closeUploadSources(sources []uploadSource) {
+	for _, s := range sources {
+		s.Close()
+	}
+}
+
+// FileHeader.Filename has any directories stripped, but browsers send the relative path of each
+// file for directory uploads.
+func multipartFilePath(fh *multipart.FileHeader) (ret []string, err error) {
+	fileName := fh.Filename
+	_, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		fileName = params["filename"]
+	}
+	for _, comp := range strings.Split(fileName, "/") {
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			return nil, errors.New("file name %q escapes upload", fileName)
+		}
+		ret = append(ret, comp)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("empty file name %q", fileName)
+	}
+	return ret, nil
+}
+
+// Picks the name of a multi-file upload if the client didn't give one, trimming the directory
+// from the file paths if they're all in the same one.
+func multiFileUploadName(sources []uploadSource) string {
+	paths := make([][]string, 0, len(sources))
+	for _, s := range sources {
+		paths = append(paths, s.path)
+	}
+	if dir := commonTopLevelDir(paths); dir != "" {
+		for i := range sources {
+			sources[i].path = sources[i].path[1:]
+		}
+		return dir
+	}
+	// Something like a video and its subtitles are likely to share a stem.
+	base := sources[0].path[len(sources[0].path)-1]
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+func createUploadTempFile() (*os.File, error) {
+	// This is for testing temp file failures.
+	const forceTempFileFailure = false
+	if forceTempFileFailure {
+		return nil, errors.New("sike")
+	}
+	return ioutil.TempFile("", "")
+}
+
+func removeUploadTempFiles(tmpFiles []*os.File) {
+	for _, f := range tmpFiles {
+		if f == nil {
+			continue
+		}
+		f.Close()
+		// Files that were kept have been moved already.
+		os.Remove(f.Name())
+	}
+}
+
+func (me *HttpHandler) handleUpload(rw InstrumentedResponseWriter, r *http.Request) (err error) {
 	// Set status code to 204 to handle preflight CORS check
 	if r.Method == "OPTIONS" {
 		rw.WriteHeader(http.StatusNoContent)
@@ -447,62 +770,78 @@ func (me *HttpHandler) handleUpload(rw InstrumentedResponseWriter, r *http.Reque
 		// Maybe we can differentiate form handling based on the method.
 	}
 
-	uploadOptions := service.NewUploadOptions(r)
-	fileName := r.URL.Query().Get("name")
-
-	var fileReader io.Reader
-	{
-		// There are streaming ways and helpers for temporary files for this if size becomes an issue.
-		formFile, fileHeader, err := r.FormFile("file")
-		if err == nil {
-			fileReader = formFile
-			if fileName == "" {
-				fileName = fileHeader.Filename
-			}
-		} else {
-			log.Debugf("error getting upload file as form file: %v", err)
-			fileReader = r.Body
-		}
+	fileName, sources, uploadOptions, sizeLimit, err := me.policedUploadRequest(r)
+	if err != nil {
+		return err
 	}
+	defer closeUploadSources(sources)
+	multiFile := len(sources) > 1
+	totalSize := uploadSourcesSize(sources)
 
-	scrubbedReader, err := metascrubber.GetScrubber(fileReader)
+	progress, err := me.uploadProgress.start(r.URL.Query().Get("uploadId"), totalSize)
 	if err != nil {
-		return errors.New("getting metascrubber: %v", err)
+		return err
 	}
+	defer me.uploadProgress.retire(progress)
+	rw.Header().Set("X-Replica-Upload-Id", progress.event.Id)
+	rw.Set("upload_id", progress.event.Id)
+	var result objectInfo
+	defer func() {
+		if err != nil {
+			progress.finish(nil, err)
+		} else {
+			progress.finish(&result, nil)
+		}
+		me.metrics.recordUpload(err != nil)
+	}()
 
 	var cw CountWriter
-	replicaUploadReader := io.TeeReader(scrubbedReader, &cw)
-
-	var (
-		tmpFile    *os.File
-		tmpFileErr error
-	)
-	if me.StoreUploadsLocally {
-		tmpFile, tmpFileErr = func() (*os.File, error) {
-			// This is for testing temp file failures.
-			const forceTempFileFailure = false
-			if forceTempFileFailure {
-				return nil, errors.New("sike")
+	// Parallel to sources, for those we managed to create.
+	tmpFiles := make([]*os.File, len(sources))
+	defer removeUploadTempFiles(tmpFiles)
+	serviceFiles := make([]service.MultiUploadFile, 0, len(sources))
+	for i, s := range sources {
+		scrubbedReader, err := metascrubber.GetScrubber(s)
+		if err != nil {
+			return errors.New("getting metascrubber: %v", err)
+		}
+		var replicaUploadReader io.Reader = scrubbedReader
+		if me.StoreUploadsLocally {
+			tmpFile, tmpFileErr := createUploadTempFile()
+			if tmpFileErr == nil {
+				tmpFiles[i] = tmpFile
+				replicaUploadReader = io.TeeReader(replicaUploadReader, tmpFile)
+			} else {
+				// This isn't good, but as long as we can add the torrent file metainfo to the local
+				// client, we can still spread the metadata, and S3 can take care of the data.
+				log.Errorf("error creating temporary file: %v", tmpFileErr)
 			}
-			return ioutil.TempFile("", "")
-		}()
-		if tmpFileErr == nil {
-			defer os.Remove(tmpFile.Name())
-			defer tmpFile.Close()
-			replicaUploadReader = io.TeeReader(replicaUploadReader, tmpFile)
-		} else {
-			// This isn't good, but as long as we can add the torrent file metainfo to the local
-			// client, we can still spread the metadata, and S3 can take care of the data.
-			log.Errorf("error creating temporary file: %v", tmpFileErr)
 		}
+		serviceFiles = append(serviceFiles, service.MultiUploadFile{
+			Path:   s.path,
+			Reader: io.TeeReader(replicaUploadReader, &cw),
+		})
 	}
+	progress.setPhase(uploadPhaseUploading)
 
-	output, err := me.ReplicaServiceClient.Upload(replicaUploadReader, fileName, uploadOptions)
+	serviceClient := me.uploadServiceClient(r.Context(), progress)
+	var output service.UploadOutput
+	if multiFile {
+		output, err = serviceClient.UploadFiles(fileName, serviceFiles, uploadOptions)
+	} else {
+		output, err = serviceClient.Upload(serviceFiles[0].Reader, fileName, uploadOptions)
+	}
 	// me.GaSession.EventWithLabel("replica", "upload", path.Ext(fileName))
 	if me.OnRequestReceived != nil {
 		me.OnRequestReceived("upload", path.Ext(fileName))
 	}
 	log.Debugf("uploaded %d bytes", cw.BytesWritten)
+	if sizeLimit.Exceeded() {
+		return sizeLimit.err()
+	}
+	if stdErrors.Is(err, service.ErrUploadInfoMismatch) {
+		return me.rejectUpload(output, uploadOptions, err)
+	}
 	if err != nil {
 		return errors.New("uploading with replica client: %v", err)
 	}
@@ -510,57 +849,212 @@ func (me *HttpHandler) handleUpload(rw InstrumentedResponseWriter, r *http.Reque
 	log.Debugf("uploaded replica key %q", upload)
 	rw.Set("upload_s3_key", upload.PrefixString())
 
-	if me.StoreMetainfoFileAndTokenLocally {
-		var metainfoBytes bytes.Buffer
-		err = output.MetaInfo.Write(&metainfoBytes)
-		if err != nil {
-			return errors.New("writing metainfo: %v", err)
+	if !output.Verified && me.StoreUploadsLocally {
+		sentPaths := make([][]string, 0, len(sources))
+		for _, s := range sources {
+			sentPaths = append(sentPaths, s.path)
 		}
-		err = storeUploadedTorrent(&metainfoBytes, me.uploadMetainfoPath(upload))
-		if err != nil {
-			return errors.New("storing uploaded torrent: %v", err)
+		if err = me.verifyUploadLocalCopy(&output, uploadOptions, tmpFiles, sentPaths); err != nil {
+			return err
 		}
+	}
+	rw.Set("upload_verified", output.Verified)
+
+	result, err = me.storeCompletedUpload(output, uploadOptions, tmpFiles, progress)
+	if err != nil {
+		return err
+	}
+	return encodeJsonResponse(rw, result)
+}
+
+// A service client for an upload, which stops when ctx is done, and reports what the service has
+// taken to progress.
+func (me *HttpHandler) uploadServiceClient(ctx context.Context, progress *uploadProgress) service.ServiceClient {
+	cl := me.ReplicaServiceClient.WithContext(ctx)
+	cl.OnUploadContentSent = func(n int64) {
+		progress.addBytesSent(n)
+		me.metrics.uploadBytesSent.Add(n)
+	}
+	return cl
+}
+
+// Checks our copy of an upload when the service hashed it differently than expected. Uploads the
+// service got wrong are rejected.
+func (me *HttpHandler) verifyUploadLocalCopy(
+	output *service.UploadOutput,
+	uploadOptions service.UploadOptions,
+	tmpFiles []*os.File,
+	sentPaths [][]string,
+) error {
+	verifyErr := verifyUploadTempFiles(&output.Info, tmpFiles, sentPaths)
+	if stdErrors.Is(verifyErr, service.ErrUploadInfoMismatch) {
+		return me.rejectUpload(*output, uploadOptions, verifyErr)
+	}
+	if verifyErr != nil {
+		log.Errorf("verifying local copy of upload %q: %v", output.Upload, verifyErr)
+	} else {
+		output.Verified = true
+	}
+	return nil
+}
 
-		if err = me.writeNewUploadAuthTokenFile(*output.AuthToken, upload.Prefix); err != nil {
-			log.Errorf("error writing upload auth token file: %v", err)
+// Handles an upload whose info doesn't match what was sent. It isn't seeded, but it isn't deleted
+// either, since the service might only have renamed something. If metainfo and tokens are kept, it's
+// listed with the other uploads so the user can delete it.
+func (me *HttpHandler) rejectUpload(output service.UploadOutput, uploadOptions service.UploadOptions, verifyErr error) error {
+	if me.StoreMetainfoFileAndTokenLocally {
+		if err := me.storeUploadMetainfo(output, uploadOptions); err != nil {
+			log.Errorf("storing metainfo for rejected upload %q: %v", output.Upload, err)
 		}
 	}
+	return handlerError{http.StatusBadGateway, errors.New("verifying upload %q: %v", output.Upload, verifyErr)}
+}
+
+// Stores the metainfo, token and options of an upload, which is what lists it in /uploads.
+func (me *HttpHandler) storeUploadMetainfo(output service.UploadOutput, uploadOptions service.UploadOptions) error {
+	upload := output.Upload
+	var metainfoBytes bytes.Buffer
+	err := output.MetaInfo.Write(&metainfoBytes)
+	if err != nil {
+		return errors.New("writing metainfo: %v", err)
+	}
+	err = storeUploadedTorrent(&metainfoBytes, me.uploadMetainfoPath(upload))
+	if err != nil {
+		return errors.New("storing uploaded torrent: %v", err)
+	}
+	if err := me.UploadTokenStore.Put(upload.Prefix, *output.AuthToken); err != nil {
+		log.Errorf("error writing upload auth token file: %v", err)
+	}
+	if err := me.storeUploadOptions(upload.Prefix, uploadOptions); err != nil {
+		log.Errorf("error storing upload options: %v", err)
+	}
+	return nil
+}
 
-	if tmpFileErr == nil && me.StoreUploadsLocally {
-		// Windoze might complain if we don't close the handle before moving the file, plus it's
-		// considered good practice to check for close errors after writing to a file. (I'm not
-		// closing it, but at least I'm flushing anything, if it's incomplete at this point, the
-		// torrent client will complete it as required.
-		tmpFile.Close()
-		// Move the temporary file, which contains the upload body, to the data directory for the
-		// torrent client, in the location it expects.
-		dst := filepath.Join(append([]string{me.dataDir, upload.String()}, output.Info.UpvertedFiles()[0].Path...)...)
-		err = os.MkdirAll(filepath.Dir(dst), 0o700)
+// Keeps what's configured of a finished upload: the metainfo, token and options, the data, and
+// the torrent. tmpFiles hold the scrubbed content that was uploaded, if it was kept, and are moved
+// into the data directory.
+func (me *HttpHandler) storeCompletedUpload(
+	output service.UploadOutput,
+	uploadOptions service.UploadOptions,
+	tmpFiles []*os.File,
+	progress *uploadProgress,
+) (result objectInfo, err error) {
+	upload := output.Upload
+	if me.StoreMetainfoFileAndTokenLocally {
+		progress.setPhase(uploadPhaseStoringMetainfo)
+		err = me.storeUploadMetainfo(output, uploadOptions)
 		if err != nil {
-			return errors.New("creating data directory: %v: %v", dst, err)
+			return
 		}
-		err = os.Rename(tmpFile.Name(), dst)
-		if err != nil {
-			// Not fatal: See above, we only really need the metainfo to be added to the torrent.
-			log.Errorf("error renaming file: %v", err)
+	}
+
+	if me.StoreUploadsLocally && !output.Verified {
+		log.Errorf("not keeping local copy of unverified upload %q", upload)
+	} else if me.StoreUploadsLocally {
+		dsts, pathsErr := fileStoragePaths(me.dataDir, &output.Info)
+		for i, tmpFile := range tmpFiles {
+			if tmpFile == nil {
+				continue
+			}
+			if pathsErr != nil {
+				log.Errorf("not keeping local copy of upload %q: %v", upload, pathsErr)
+				break
+			}
+			if len(dsts) != len(tmpFiles) {
+				log.Errorf("uploaded %v files, but service returned %v", len(tmpFiles), len(dsts))
+				break
+			}
+			// Windoze might complain if we don't close the handle before moving the file, plus it's
+			// considered good practice to check for close errors after writing to a file. (I'm not
+			// closing it, but at least I'm flushing anything, if it's incomplete at this point, the
+			// torrent client will complete it as required.
+			tmpFile.Close()
+			// Move the temporary file, which contains the upload body, to the data directory for
+			// the torrent client, in the location it expects.
+			dst := dsts[i]
+			err = os.MkdirAll(filepath.Dir(dst), 0o700)
+			if err != nil {
+				err = errors.New("creating data directory: %v: %v", dst, err)
+				return
+			}
+			err = os.Rename(tmpFile.Name(), dst)
+			if err != nil {
+				// Not fatal: See above, we only really need the metainfo to be added to the torrent.
+				log.Errorf("error renaming file: %v", err)
+			}
 		}
 	}
 	if me.AddUploadsToTorrentClient {
+		progress.setPhase(uploadPhaseAddingToTorrentClient)
 		err = me.addUploadTorrent(output.MetaInfo, true)
 		if err != nil {
-			return errors.New("adding torrent: %v", err)
+			err = errors.New("adding torrent: %v", err)
+			return
 		}
 	}
-	var oi objectInfo
-	err = oi.FromUploadMetainfo(output.UploadMetainfo, time.Now())
+	err = result.FromUploadMetainfo(output.UploadMetainfo, time.Now())
 	if err != nil {
-		return errors.New("getting objectInfo from upload metainfo: %v", err)
+		err = errors.New("getting objectInfo from upload metainfo: %v", err)
+		return
 	}
 	// We can clobber with what should be a superior link directly from the upload service endpoint.
 	if output.Link != nil {
-		oi.Link = *output.Link
+		result.Link = *output.Link
+	}
+	result.setUploadOptions(uploadOptions)
+	return
+}
+
+// Where file storage in dir keeps the data for the info: the file itself for single-file infos,
+// otherwise the directory holding the files.
+func fileStorageRoot(dir string, info *metainfo.Info) (string, error) {
+	name := info.BestName()
+	if name == metainfo.NoName {
+		return "", errors.New("info has no name")
+	}
+	p, err := storage.ToSafeFilePath(name)
+	if err != nil {
+		return "", errors.New("info name %q: %v", name, err)
+	}
+	if p == "." {
+		return "", errors.New("info name %q is the storage directory", name)
+	}
+	return filepath.Join(dir, p), nil
+}
+
+// Where file storage in dir keeps each file of the info.
+func fileStoragePaths(dir string, info *metainfo.Info) (ret []string, err error) {
+	root, err := fileStorageRoot(dir, info)
+	if err != nil {
+		return
+	}
+	for _, fi := range info.UpvertedFiles() {
+		p, err := storage.ToSafeFilePath(fi.BestPath()...)
+		if err != nil {
+			return nil, errors.New("file path %q: %v", fi.BestPath(), err)
+		}
+		ret = append(ret, filepath.Join(root, p))
+	}
+	return
+}
+
+// Checks local copies of upload files against the info the service returned, for when it wasn't
+// possible to do so while uploading.
+func verifyUploadTempFiles(info *metainfo.Info, tmpFiles []*os.File, paths [][]string) error {
+	hasher := service.NewPieceHasher(info.PieceLength)
+	files := make([]service.UploadedFile, 0, len(tmpFiles))
+	for i, f := range tmpFiles {
+		if f == nil {
+			return errors.New("no local copy of file %v", i)
+		}
+		n, err := io.Copy(hasher, io.NewSectionReader(f, 0, math.MaxInt64))
+		if err != nil {
+			return errors.New("hashing local copy of file %v: %v", i, err)
+		}
+		files = append(files, service.UploadedFile{Path: paths[i], Length: n})
 	}
-	return encodeJsonResponse(rw, oi)
+	return service.VerifyUploadInfo(info, files, hasher)
 }
 
 func (me *HttpHandler) addUploadTorrent(mi *metainfo.MetaInfo, concealUploaderIdentity bool) error {
@@ -600,6 +1094,11 @@ func (me *HttpHandler) handleUploads(rw InstrumentedResponseWriter, r *http.Requ
 			log.Errorf("error parsing upload metainfo for %q: %v", iu.FileInfo.Name(), err)
 			return
 		}
+		uploadOptions, _, err := me.loadUploadOptions(mi.Upload.Prefix)
+		if err != nil {
+			log.Errorf("error loading upload options for %q: %v", mi.Upload.Prefix, err)
+		}
+		oi.setUploadOptions(uploadOptions)
 		resp = append(resp, oi)
 	})
 	if err != nil {
@@ -608,58 +1107,85 @@ func (me *HttpHandler) handleUploads(rw InstrumentedResponseWriter, r *http.Requ
 	return encodeJsonResponse(rw, resp)
 }
 
-func (me *HttpHandler) handleDelete(rw InstrumentedResponseWriter, r *http.Request) (err error) {
-	link := r.URL.Query().Get("link")
-	m, err := metainfo.ParseMagnetUri(link)
+// Parses a link to one of our uploads, as returned by the uploads endpoint.
+func uploadFromLink(link string) (m metainfo.Magnet, upload service.Upload, err error) {
+	m, err = metainfo.ParseMagnetUri(link)
 	if err != nil {
-		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+		err = handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+		return
 	}
-
-	var upload service.Upload
-	if err := upload.FromMagnet(m); err != nil {
+	if err = upload.FromMagnet(m); err != nil {
 		log.Errorf("error getting upload spec from magnet link %q: %v", m, err)
-		return handlerError{http.StatusBadRequest, errors.New("parsing replica uri: %v", err)}
+		err = handlerError{http.StatusBadRequest, errors.New("parsing replica uri: %v", err)}
+	}
+	return
+}
+
+func (me *HttpHandler) handleDelete(rw InstrumentedResponseWriter, r *http.Request) (err error) {
+	m, upload, err := uploadFromLink(r.URL.Query().Get("link"))
+	if err != nil {
+		return
 	}
 
 	// The prefixes returned from the uploads endpoint contain the file stem for the token file.
-	uploadAuthFilePath := me.uploadTokenPath(upload.Prefix)
-	authBytes, readAuthErr := ioutil.ReadFile(uploadAuthFilePath)
+	auth, readAuthErr := me.UploadTokenStore.Get(upload.Prefix)
+	if readAuthErr != nil && !isNotExist(readAuthErr) {
+		// Deleting without auth is for when we never had the token, not when we can't read it.
+		return errors.New("reading upload token: %v", readAuthErr)
+	}
 
 	metainfoFilePath := me.uploadMetainfoPath(upload)
-	_, loadMetainfoErr := metainfo.LoadFromFile(metainfoFilePath)
+	mi, loadMetainfoErr := metainfo.LoadFromFile(metainfoFilePath)
 
 	if readAuthErr == nil || loadMetainfoErr == nil {
-		log.Debugf("deleting %q (auth=%q, haveMetainfo=%t)",
+		log.Debugf("deleting %q (haveAuth=%t, haveMetainfo=%t)",
 			upload.Prefix,
-			string(authBytes),
-			loadMetainfoErr == nil && os.IsNotExist(readAuthErr))
+			readAuthErr == nil,
+			loadMetainfoErr == nil && isNotExist(readAuthErr))
 		// We're not inferring the endpoint from the link, should we?
 		err := me.ReplicaServiceClient.DeleteUpload(
 			upload.Prefix,
-			string(authBytes),
-			loadMetainfoErr == nil && os.IsNotExist(readAuthErr),
+			auth,
+			loadMetainfoErr == nil && isNotExist(readAuthErr),
 		)
 		if err != nil {
-			// It could be possible to unpack the service response status code and relay that.
 			return errors.New("deleting upload: %v", err)
 		}
 		t, ok := me.torrentClient.Torrent(m.InfoHash)
 		if ok {
 			t.Drop()
 		}
-		os.RemoveAll(filepath.Join(me.dataDir, upload.String()))
+		if loadMetainfoErr == nil {
+			me.removeUploadLocalCopy(mi)
+		}
 		os.Remove(metainfoFilePath)
-		os.Remove(uploadAuthFilePath)
+		me.UploadTokenStore.Delete(upload.Prefix)
+		os.Remove(me.uploadOptionsPath(upload.Prefix))
 	}
-	if os.IsNotExist(loadMetainfoErr) && os.IsNotExist(readAuthErr) {
+	if isNotExist(loadMetainfoErr) && isNotExist(readAuthErr) {
 		return handlerError{http.StatusGone, errors.New("no upload tokens found")}
 	}
-	if !os.IsNotExist(readAuthErr) {
+	if !isNotExist(readAuthErr) {
 		return readAuthErr
 	}
 	return loadMetainfoErr
 }
 
+// Removes what was kept of the upload's data for the torrent client.
+func (me *HttpHandler) removeUploadLocalCopy(mi *metainfo.MetaInfo) {
+	info, err := mi.UnmarshalInfo()
+	if err == nil {
+		var root string
+		root, err = fileStorageRoot(me.dataDir, &info)
+		if err == nil {
+			err = os.RemoveAll(root)
+		}
+	}
+	if err != nil {
+		log.Errorf("removing local copy of upload %v: %v", mi.HashInfoBytes(), err)
+	}
+}
+
 func copySpecificHeaders(dst, src http.Header, keys []string) {
 	for _, k := range keys {
 		for _, v := range src.Values(k) {
@@ -701,7 +1227,7 @@ func (me *HttpHandler) handleMetadata(category string) func(InstrumentedResponse
 		}
 		gc := me.GlobalConfig()
 		key := fmt.Sprintf("%s/%s/%d", m.InfoHash.HexString(), category, fileIndex)
-		resp, err := doFirst(mr, me.HttpClient, func(r *http.Response) bool {
+		resp, err := doFirst(mr, me.HttpClient, me.metrics, func(r *http.Response) bool {
 			return r.StatusCode/100 == 2
 		}, func() (ret []string) {
 			for _, s := range gc.GetMetadataBaseUrls() {
@@ -740,10 +1266,11 @@ func (me *HttpHandler) handleMetadata(category string) func(InstrumentedResponse
 }
 
 // Returns the first response for which the filter returns true. Otherwise a result is selected at
-// random.
+// random. Which sources were used or failed is recorded in metrics.
 func doFirst(
 	req *http.Request,
 	client *http.Client,
+	metrics *metricsRegistry,
 	filter func(r *http.Response) bool,
 	urls []string,
 ) (*http.Response, error) {
@@ -783,9 +1310,17 @@ func doFirst(
 		gotOne := false
 		for range urls {
 			res := <-results
-			if !gotOne && res.error == nil && filter(res.Response) {
+			usable := res.error == nil && filter(res.Response)
+			// Errors after a winner, or after the caller gave up, are likely from our cancelling
+			// the request, and say nothing about the source.
+			cancelled := res.error != nil && (gotOne || req.Context().Err() != nil)
+			if !usable && !cancelled {
+				metrics.recordSource(urls[res.urlIndex], false)
+			}
+			if !gotOne && usable {
 				retChan <- res
 				gotOne = true
+				metrics.recordSource(urls[res.urlIndex], true)
 			} else {
 				rejected = append(rejected, res)
 			}
@@ -833,6 +1368,9 @@ func (me *HttpHandler) handleSearch(rw InstrumentedResponseWriter, r *http.Reque
 }
 
 func (me *HttpHandler) handleDownload(rw InstrumentedResponseWriter, r *http.Request) error {
+	if r.URL.Query().Has("format") {
+		return me.handleArchiveDownload(rw, r)
+	}
 	return me.handleViewWith(rw, r, "attachment")
 }
 
@@ -842,6 +1380,12 @@ func (me *HttpHandler) handleView(rw InstrumentedResponseWriter, r *http.Request
 
 // This is extracted out so external packages can apply configs appropriately.
 func ApplyReplicaOptions(ro ReplicaOptions, t *torrent.Torrent) {
+	addReplicaPeers(ro, t)
+	t.UseSources(getMetainfoUrls(ro, t.InfoHash().HexString()))
+}
+
+// Adds the trackers, static peers and webseeds from the replica options.
+func addReplicaPeers(ro ReplicaOptions, t *torrent.Torrent) {
 	prefix := t.InfoHash().HexString()
 	t.AddTrackers([][]string{ro.GetTrackers()})
 	for _, peerAddr := range ro.GetStaticPeerAddrs() {
@@ -851,7 +1395,6 @@ func ApplyReplicaOptions(ro ReplicaOptions, t *torrent.Torrent) {
 			Trusted: true,
 		}})
 	}
-	t.UseSources(getMetainfoUrls(ro, prefix))
 	t.AddWebSeeds(getWebseedUrls(ro, prefix))
 }
 
@@ -878,33 +1421,31 @@ func (me *HttpHandler) handleViewWith(rw InstrumentedResponseWriter, r *http.Req
 		t.SetDisplayName(m.DisplayName)
 	}
 
-	ApplyReplicaOptions(gc, t)
+	// The metainfo sources are tried explicitly while waiting for the info.
+	addReplicaPeers(gc, t)
 
-	selectOnly, err := strconv.ParseUint(m.Params.Get("so"), 10, 0)
-	// Assume that it should be present, as it'll be added going forward where possible. When it's
-	// missing, zero is a perfectly adequate default for now.
+	// wrapHandlerError adjusts log severity appropriately for context.Canceled.
+	err = me.waitForTorrentInfo(r.Context(), t, metainfoUrls(m, gc))
 	if err != nil {
-		log.Errorf("error parsing so field: %v", err)
+		return err
+	}
+	torrentFile, err := selectTorrentFile(t, m, r.URL.Query())
+	if err != nil {
+		return err
 	}
-	// TODO <21-04-2022, soltzen> add a timeout to the context
-	// https://github.com/getlantern/lantern-internal/issues/5483
-	select {
-	case <-r.Context().Done():
-		// wrapHandlerError now adjusts log severity appropriately for context.Canceled.
-		return r.Context().Err()
-	case <-t.GotInfo():
+	filename := m.DisplayName
+	if r.URL.Query().Has("path") {
+		filename = path.Base(torrentFile.DisplayPath())
 	}
-	filename := firstNonEmptyString(
+	filename = firstNonEmptyString(
+		filename,
 		// Note that serving the torrent implies waiting for the info, and we could get a better
 		// name for it after that. Torrent.Name will also allow us to reuse previously given 'dn'
 		// values, if we don't have one now.
-		m.DisplayName,
 		t.Name(),
 	)
+	filename = sanitizeFileName(filename)
 	ext := path.Ext(filename)
-	if ext != "" {
-		filename = sanitize.BaseName(strings.TrimSuffix(filename, ext)) + ext
-	}
 	if filename != "" {
 		rw.Header().Set("Content-Disposition", inlineType+"; filename*=UTF-8''"+url.QueryEscape(filename))
 	}
@@ -923,7 +1464,6 @@ func (me *HttpHandler) handleViewWith(rw InstrumentedResponseWriter, r *http.Req
 		}
 	}
 
-	torrentFile := t.Files()[selectOnly]
 	fileReader := torrentFile.NewReader()
 	defer fileReader.Close()
 	rw.Header().Set("Cache-Control", "public, max-age=604800, immutable")
@@ -931,6 +1471,15 @@ func (me *HttpHandler) handleViewWith(rw InstrumentedResponseWriter, r *http.Req
 	return nil
 }
 
+// Makes a name safe to use as a file name. Names without extensions are left alone.
+func sanitizeFileName(filename string) string {
+	ext := path.Ext(filename)
+	if ext != "" {
+		filename = sanitize.BaseName(strings.TrimSuffix(filename, ext)) + ext
+	}
+	return filename
+}
+
 func metainfoUrls(link metainfo.Magnet, config ReplicaOptions) (ret []string) {
 	ret = getMetainfoUrls(config, link.InfoHash.HexString())
 	var upload service.Upload
@@ -950,6 +1499,7 @@ func (me *HttpHandler) handleObjectInfo(rw InstrumentedResponseWriter, r *http.R
 	resp, err := doFirst(
 		(&http.Request{}).WithContext(r.Context()),
 		me.HttpClient,
+		me.metrics,
 		func(r *http.Response) bool {
 			if r.StatusCode != http.StatusOK {
 				return false
@@ -986,7 +1536,7 @@ func (me *HttpHandler) handleObjectInfo(rw InstrumentedResponseWriter, r *http.R
 	key := fmt.Sprintf("%s/metadata", m.InfoHash.HexString())
 
 	resp, err = doFirst(
-		mr, me.HttpClient,
+		mr, me.HttpClient, me.metrics,
 		func(r *http.Response) bool {
 			// Should we check for no encoding and JSON here?
 			return r.StatusCode/100 == 2
@@ -1055,8 +1605,9 @@ func (me *HttpHandler) uploadMetainfoPath(upload service.Upload) string {
 	return filepath.Join(me.uploadsDir, upload.String()+".torrent")
 }
 
-func (me *HttpHandler) uploadTokenPath(prefix service.Prefix) string {
-	return filepath.Join(me.uploadsDir, prefix.PrefixString()+".token")
+// Title, description etc. aren't in the metainfo, so we keep our own copy.
+func (me *HttpHandler) uploadOptionsPath(prefix service.Prefix) string {
+	return filepath.Join(me.uploadsDir, prefix.PrefixString()+".json")
 }
 
 func encodeJsonResponse(rw http.ResponseWriter, resp interface{}) error {
@@ -1087,6 +1638,9 @@ func (me *HttpHandler) metricsExporter() {
 		select {
 		case <-me.closed.Done():
 			return
+		case <-me.shuttingDown.Done():
+			// Shutdown does the final export.
+			return
 		case <-time.After(5 * time.Minute):
 		}
 	}
@@ -1,24 +1,69 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
 	qt "github.com/frankban/quicktest"
+	"github.com/getlantern/errors"
 	"github.com/getlantern/golog/testlog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
 )
 
+type testReplicaOptions struct {
+	FallbackReplicaOptions
+	webseedBaseUrls []string
+}
+
+func (me testReplicaOptions) GetWebseedBaseUrls() []string {
+	return me.webseedBaseUrls
+}
+
+// Creates a full handler using srv for the Replica service and webseeding.
+func newServicetestHandler(t *testing.T, srv *servicetest.Server, configure func(*NewHttpHandlerInput)) *HttpHandler {
+	input := NewHttpHandlerInput{}
+	input.SetDefaults()
+	input.UploadTokenSecret = []byte("secret")
+	input.ReplicaServiceClient = srv.ServiceClient()
+	input.GlobalConfig = func() ReplicaOptions {
+		return testReplicaOptions{webseedBaseUrls: []string{srv.WebseedBaseUrl()}}
+	}
+	input.RootUploadsDir = t.TempDir()
+	input.CacheDir = t.TempDir()
+	if configure != nil {
+		configure(&input)
+	}
+	handler, err := NewHTTPHandler(input)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		handler.Close()
+		// So nothing in the background is left using the test's directories.
+		handler.background.stop()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownCancelGrace)
+		defer cancel()
+		assert.NoError(t, handler.background.wait(ctx), handler.background.list())
+	})
+	return handler
+}
+
 // TestUploadAndDelete makes sure we can upload and then subsequently delete a given file.
 func TestUploadAndDelete(t *testing.T) {
 	stopCapture := testlog.Capture(t)
@@ -27,12 +72,12 @@ func TestUploadAndDelete(t *testing.T) {
 	dir := t.TempDir()
 	input := NewHttpHandlerInput{}
 	input.SetDefaults()
-	input.ReplicaServiceClient = service.ServiceClient{
-		// XXX Use this endpoint to communicate directly with replica-rust,
-		ReplicaServiceEndpoint: func() *url.URL { return service.GlobalChinaDefaultServiceUrl },
-		// For local tests, build & run replica-rust and use the local loopback address
-		// ReplicaServiceEndpoint: func () *url.URL { return &url.URL{Scheme: "http", Host: "localhost:8080"} }
-		HttpClient: http.DefaultClient,
+	input.UploadTokenSecret = []byte("secret")
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	input.ReplicaServiceClient = srv.ServiceClient()
+	input.GlobalConfig = func() ReplicaOptions {
+		return testReplicaOptions{webseedBaseUrls: []string{srv.WebseedBaseUrl()}}
 	}
 	input.RootUploadsDir = dir
 	handler, err := NewHTTPHandler(input)
@@ -59,6 +104,7 @@ func TestUploadAndDelete(t *testing.T) {
 	// We expect a token file and metainfo.
 	require.Equal(t, 2, len(files))
 	assert.Len(t, handler.torrentClient.Torrents(), 0)
+	assert.Len(t, srv.Objects(), 1)
 
 	magnetLink := uploadedObjectInfo.Link
 
@@ -80,6 +126,7 @@ func TestUploadAndDelete(t *testing.T) {
 	require.NoError(t, err)
 	// We expect the delete handler to have removed the token and metainfo files.
 	require.Empty(t, files)
+	assert.Empty(t, srv.Objects())
 }
 
 // TestUploadAndDelete_DontSaveUploads makes sure we can upload a file and not
@@ -92,12 +139,12 @@ func TestUploadAndDelete_DontSaveUploads(t *testing.T) {
 	dir := t.TempDir()
 	input := NewHttpHandlerInput{}
 	input.SetDefaults()
-	input.ReplicaServiceClient = service.ServiceClient{
-		// XXX Use this endpoint to communicate directly with replica-rust,
-		ReplicaServiceEndpoint: func() *url.URL { return service.GlobalChinaDefaultServiceUrl },
-		// For local tests, build & run replica-rust and use the local loopback address
-		// ReplicaServiceEndpoint: func () *url.URL { return &url.URL{Scheme: "http", Host: "localhost:8080"} }
-		HttpClient: http.DefaultClient,
+	input.UploadTokenSecret = []byte("secret")
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	input.ReplicaServiceClient = srv.ServiceClient()
+	input.GlobalConfig = func() ReplicaOptions {
+		return testReplicaOptions{webseedBaseUrls: []string{srv.WebseedBaseUrl()}}
 	}
 	input.RootUploadsDir = dir
 	input.AddUploadsToTorrentClient = false
@@ -130,6 +177,113 @@ func TestUploadAndDelete_DontSaveUploads(t *testing.T) {
 	require.Empty(t, handler.torrentClient.Torrents())
 }
 
+// Uploads kept locally should be where the torrent client's storage looks for them, so they're
+// seeded.
+func TestUploadStoredLocallyIsComplete(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		input.StoreUploadsLocally = true
+		input.AddUploadsToTorrentClient = true
+	})
+	upload := func(r *http.Request) metainfo.Magnet {
+		w := httptest.NewRecorder()
+		require.NoError(t, handler.handleUpload(&NoopInstrumentedResponseWriter{w}, r))
+		var oi objectInfo
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &oi))
+		m, err := metainfo.ParseMagnetUri(oi.Link)
+		require.NoError(t, err)
+		tor, ok := handler.torrentClient.Torrent(m.InfoHash)
+		require.True(t, ok)
+		<-tor.GotInfo()
+		tor.VerifyData()
+		assert.Equal(t, tor.Length(), tor.BytesCompleted())
+		assert.True(t, tor.Complete().Bool())
+		return m
+	}
+
+	m := upload(httptest.NewRequest(http.MethodPost, "/upload?name=testfile", strings.NewReader("file content")))
+	tor, _ := handler.torrentClient.Torrent(m.InfoHash)
+	dataPaths, err := fileStoragePaths(handler.dataDir, tor.Info())
+	require.NoError(t, err)
+	require.Len(t, dataPaths, 1)
+	assert.FileExists(t, dataPaths[0])
+	d := httptest.NewRequest(http.MethodGet, "/delete?"+url.Values{"link": {m.String()}}.Encode(), nil)
+	require.NoError(t, handler.handleDelete(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, d))
+	assert.NoFileExists(t, dataPaths[0])
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"show/video.mp4", "show/video.srt"} {
+		w, err := mw.CreateFormFile("file", name)
+		require.NoError(t, err)
+		io.WriteString(w, name)
+	}
+	require.NoError(t, mw.Close())
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	upload(r)
+}
+
+// Uploads the service gets wrong aren't seeded, and are left for the user to delete.
+func TestUploadRejectedForMismatchedInfo(t *testing.T) {
+	deleted := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/delete" {
+			deleted = true
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.NotFound(w, r)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		other := []byte("not what was uploaded")
+		info := metainfo.Info{Name: "prefix", PieceLength: 1 << 18, Files: []metainfo.FileInfo{{
+			Path:   []string{"testfile"},
+			Length: int64(len(other)),
+		}}}
+		require.NoError(t, info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(other)), nil
+		}))
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		json.NewEncoder(w).Encode(service.ServiceUploadOutput{
+			Link:       mi.Magnet(nil, &info).String() + "&xs=replica:prefix",
+			Metainfo:   service.JsonBinaryString{Bytes: bencode.MustMarshal(mi)},
+			AdminToken: "token",
+		})
+	}))
+	defer srv.Close()
+	input := NewHttpHandlerInput{}
+	input.SetDefaults()
+	input.UploadTokenSecret = []byte("secret")
+	input.ReplicaServiceClient = service.ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+	}
+	input.RootUploadsDir = t.TempDir()
+	input.CacheDir = t.TempDir()
+	input.StoreUploadsLocally = true
+	input.AddUploadsToTorrentClient = true
+	handler, err := NewHTTPHandler(input)
+	require.NoError(t, err)
+	defer handler.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/upload?name=testfile", strings.NewReader("file content"))
+	err = handler.handleUpload(&NoopInstrumentedResponseWriter{w}, r)
+	var he handlerError
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadGateway, he.statusCode)
+	assert.ErrorIs(t, err, service.ErrUploadInfoMismatch)
+	assert.False(t, deleted)
+	assert.Empty(t, handler.torrentClient.Torrents())
+	token, err := handler.UploadTokenStore.Get("prefix")
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	assert.FileExists(t, handler.uploadMetainfoPath(service.Upload{UploadPrefix: service.UploadPrefixFromString("prefix")}))
+}
+
 func TestWalkTorrentClientStatsForExport(t *testing.T) {
 	fields := make(map[string]any)
 	stats := torrent.ClientStats{}
@@ -151,3 +305,74 @@ func TestWalkTorrentClientStatsForExport(t *testing.T) {
 	c := qt.New(t)
 	c.Check(fields["ConnStats.BytesReadUsefulData"], qt.Equals, int64(69))
 }
+
+func TestObjectInfoFromMultiFileUpload(t *testing.T) {
+	info := metainfo.Info{
+		Name:        "prefix",
+		PieceLength: 1 << 14,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"show", "video.mp4"}, Length: 3},
+			{Path: []string{"show", "video.srt"}, Length: 2},
+		},
+	}
+	require.NoError(t, info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("abcde")), nil
+	}))
+	mi := &metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+	var umi service.UploadMetainfo
+	require.NoError(t, umi.FromTorrentMetainfo(mi, "prefix.torrent"))
+	var oi objectInfo
+	require.NoError(t, oi.FromUploadMetainfo(umi, time.Now()))
+	c := qt.New(t)
+	c.Check(oi.DisplayName, qt.Equals, "show")
+	c.Check(oi.FileSize, qt.Equals, int64(5))
+	c.Assert(oi.Files, qt.HasLen, 2)
+	c.Check(oi.Files[1].DisplayName, qt.Equals, "show/video.srt")
+	c.Check(oi.Files[1].FileSize, qt.Equals, int64(2))
+	m, err := metainfo.ParseMagnetUri(oi.Link)
+	c.Assert(err, qt.IsNil)
+	c.Check(m.Params.Has("so"), qt.IsFalse)
+	m, err = metainfo.ParseMagnetUri(oi.Files[1].Link)
+	c.Assert(err, qt.IsNil)
+	c.Check(m.Params.Get("so"), qt.Equals, "1")
+	c.Check(m.Params.Get("xs"), qt.Equals, "replica:prefix")
+}
+
+func TestMultipartUploadSources(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"show/video.mp4", "show/subs/en.srt"} {
+		w, err := mw.CreateFormFile("file", name)
+		require.NoError(t, err)
+		io.WriteString(w, name)
+	}
+	require.NoError(t, mw.Close())
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	sources, err := uploadSources(r, "")
+	require.NoError(t, err)
+	defer closeUploadSources(sources)
+	require.Len(t, sources, 2)
+	assert.Equal(t, "show", multiFileUploadName(sources))
+	assert.Equal(t, []string{"video.mp4"}, sources[0].path)
+	assert.Equal(t, []string{"subs", "en.srt"}, sources[1].path)
+	assert.EqualValues(t, len("show/subs/en.srt"), sources[1].size)
+}
+
+func TestWrapHandlerErrorServiceError(t *testing.T) {
+	handler := HttpHandler{metrics: newMetricsRegistry()}
+	handler.NewHttpHandlerInput.SetDefaults()
+	h := handler.wrapHandlerError("test", func(InstrumentedResponseWriter, *http.Request) error {
+		return errors.New("deleting upload: %v", &service.Error{
+			StatusCode: http.StatusPaymentRequired,
+			Category:   service.ErrorCategoryPayloadTooLarge,
+		})
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/delete", nil))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "payload_too_large", resp["errorCode"])
+	assert.Equal(t, false, resp["retryable"])
+}
@@ -4,7 +4,9 @@ import (
 	"net/http"
 )
 
-// An http.ResponseWriter that exposes the ability to instrument operations.
+// An http.ResponseWriter that exposes the ability to instrument operations. Implementations should
+// implement http.Flusher, or Unwrap to a writer that does, for responses to be streamed. Otherwise
+// /upload/progress long-polls instead of sending events.
 type InstrumentedResponseWriter interface {
 	http.ResponseWriter
 	// Set value for the given key in the current context
@@ -28,6 +30,11 @@ func (rw *NoopInstrumentedResponseWriter) Finish() {}
 func (rw *NoopInstrumentedResponseWriter) FailIf(err error) {
 }
 
+// Allows http.ResponseController to reach the underlying ResponseWriter.
+func (rw *NoopInstrumentedResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (me *NewHttpHandlerInput) SetDefaults() {
 	// Should GlobalConfig be set to the default value?
 
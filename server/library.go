@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/getlantern/errors"
+)
+
+// Torrents the user has saved for offline use. Unlike the storage cache, these are kept across
+// restarts and downloaded in full.
+type library struct {
+	// Holds the item and metainfo files.
+	dir     string
+	storage storage.ClientImplCloser
+
+	mu    sync.Mutex
+	items map[metainfo.Hash]libraryItem
+	// Those added to the client with library storage.
+	torrents map[metainfo.Hash]*torrent.Torrent
+	// Items whose torrent is in use by views, to be added with library storage once they're done.
+	pending map[metainfo.Hash]libraryItem
+}
+
+type libraryItem struct {
+	InfoHash metainfo.Hash `json:"infoHash"`
+	Link     string        `json:"replicaLink"`
+	Added    time.Time     `json:"added"`
+}
+
+// A library item with the state of its download.
+type libraryEntry struct {
+	libraryItem
+	Name           string `json:"name,omitempty"`
+	InfoKnown      bool   `json:"infoKnown"`
+	BytesCompleted int64  `json:"bytesCompleted"`
+	Length         int64  `json:"length"`
+	Complete       bool   `json:"complete"`
+}
+
+// Item files are kept in dir, and torrent data in the data dir beneath it. Storage defaults to
+// FileByInfoHashStorage.
+func openLibrary(dir string, newStorage StorageFactory) (*library, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	libStorage, err := newRoleStorage(newStorage, FileByInfoHashStorage(), filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, err
+	}
+	lib := &library{
+		dir:      dir,
+		storage:  libStorage,
+		items:    make(map[metainfo.Hash]libraryItem),
+		torrents: make(map[metainfo.Hash]*torrent.Torrent),
+		pending:  make(map[metainfo.Hash]libraryItem),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		lib.storage.Close()
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		var item libraryItem
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err == nil {
+			err = json.Unmarshal(b, &item)
+		}
+		if err != nil {
+			log.Errorf("loading library item %q: %v", e.Name(), err)
+			continue
+		}
+		lib.items[item.InfoHash] = item
+	}
+	return lib, nil
+}
+
+func (me *library) itemPath(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, ih.HexString()+".json")
+}
+
+func (me *library) metainfoPath(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, ih.HexString()+".torrent")
+}
+
+func (me *library) dataDir(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, "data", ih.HexString())
+}
+
+func (me *library) get(ih metainfo.Hash) (item libraryItem, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	item, ok = me.items[ih]
+	return
+}
+
+func (me *library) list() (ret []libraryItem) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, item := range me.items {
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Added.Before(ret[j].Added)
+	})
+	return
+}
+
+// Returns false if the item was already in the library.
+func (me *library) add(item libraryItem) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.items[item.InfoHash]; ok {
+		return false, nil
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+	err = os.WriteFile(me.itemPath(item.InfoHash), b, 0o600)
+	if err != nil {
+		return false, err
+	}
+	me.items[item.InfoHash] = item
+	return true, nil
+}
+
+// Removes the item and any data for it. Returns false if it wasn't in the library.
+func (me *library) remove(ih metainfo.Hash) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.items[ih]; !ok {
+		return false, nil
+	}
+	delete(me.items, ih)
+	delete(me.pending, ih)
+	// The data can't be removed while the torrent has it open. Only storage that keeps it by
+	// infohash has it in the data dir.
+	if t, ok := me.torrents[ih]; ok {
+		t.Drop()
+		delete(me.torrents, ih)
+	}
+	err := os.Remove(me.itemPath(ih))
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	os.Remove(me.metainfoPath(ih))
+	return true, os.RemoveAll(me.dataDir(ih))
+}
+
+// Saves the metainfo so the torrent can be re-added without fetching it again.
+func (me *library) storeMetainfo(t *torrent.Torrent) error {
+	mi := t.Metainfo()
+	f, err := os.OpenFile(me.metainfoPath(t.InfoHash()), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	err = mi.Write(f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Adds a library item's torrent to the client using library storage. A torrent that's already in
+// the client and complete, like one of our uploads, is left alone. Otherwise it's added again once
+// confluence has no more views of it, so they aren't interrupted.
+func (me *HttpHandler) addLibraryTorrent(item libraryItem) error {
+	if t, ok := me.torrentClient.Torrent(item.InfoHash); ok {
+		if t.Complete().Bool() {
+			return nil
+		}
+		me.library.mu.Lock()
+		me.library.pending[item.InfoHash] = item
+		me.library.mu.Unlock()
+		// Views hold references to the torrent through confluence, so taking and releasing one
+		// ends up in onTorrentGrace once they're all done, even if there aren't any.
+		_, _, release := me.confluence.GetTorrent(item.InfoHash)
+		release()
+		return nil
+	}
+	var infoBytes []byte
+	if mi, err := metainfo.LoadFromFile(me.library.metainfoPath(item.InfoHash)); err == nil {
+		infoBytes = mi.InfoBytes
+	} else if !os.IsNotExist(err) {
+		log.Errorf("loading library metainfo for %v: %v", item.InfoHash, err)
+	}
+	return me.startLibraryTorrent(item, infoBytes)
+}
+
+// Called by confluence when the last reference to a torrent is released. Library items waiting on
+// the torrent are added again with library storage. Confluence holds its references while this
+// runs, so no view can get the torrent before it's replaced.
+func (me *HttpHandler) onTorrentGrace(t *torrent.Torrent) {
+	me.library.mu.Lock()
+	item, ok := me.library.pending[t.InfoHash()]
+	delete(me.library.pending, t.InfoHash())
+	me.library.mu.Unlock()
+	if !ok || t.Complete().Bool() {
+		return
+	}
+	var infoBytes []byte
+	if t.Info() != nil {
+		infoBytes = t.Metainfo().InfoBytes
+	}
+	t.Drop()
+	if err := me.startLibraryTorrent(item, infoBytes); err != nil {
+		log.Errorf("adding library item %v: %v", item.InfoHash, err)
+	}
+}
+
+// Adds the item's torrent to the client with library storage, and downloads it. infoBytes can be
+// nil if the info isn't known yet.
+func (me *HttpHandler) startLibraryTorrent(item libraryItem, infoBytes []byte) error {
+	m, err := metainfo.ParseMagnetUri(item.Link)
+	if err != nil {
+		return errors.New("parsing magnet link: %v", err)
+	}
+	spec := &torrent.TorrentSpec{
+		InfoHash:    item.InfoHash,
+		DisplayName: m.DisplayName,
+		Trackers:    [][]string{m.Trackers},
+		InfoBytes:   infoBytes,
+		Storage:     me.library.storage,
+	}
+	t, _, err := me.torrentClient.AddTorrentSpec(spec)
+	if err != nil {
+		return err
+	}
+	me.library.mu.Lock()
+	me.library.torrents[item.InfoHash] = t
+	me.library.mu.Unlock()
+	ApplyReplicaOptions(me.GlobalConfig(), t)
+	me.background.goActivity("library download "+item.InfoHash.HexString(), func() {
+		me.downloadLibraryTorrent(t)
+	})
+	return nil
+}
+
+// Waits for the info, and then downloads everything.
+func (me *HttpHandler) downloadLibraryTorrent(t *torrent.Torrent) {
+	select {
+	case <-t.GotInfo():
+	case <-t.Closed():
+		return
+	case <-me.closed.Done():
+		return
+	case <-me.shuttingDown.Done():
+		return
+	}
+	if _, ok := me.library.get(t.InfoHash()); !ok {
+		return
+	}
+	err := me.library.storeMetainfo(t)
+	if err != nil {
+		log.Errorf("storing library metainfo for %v: %v", t.InfoHash(), err)
+	}
+	t.DownloadAll()
+}
+
+// Adds the torrents for all the library items. Called at startup after uploads are added.
+func (me *HttpHandler) addLibraryTorrents() {
+	for _, item := range me.library.list() {
+		err := me.addLibraryTorrent(item)
+		if err != nil {
+			log.Errorf("adding library item %v: %v", item.InfoHash, err)
+		}
+	}
+}
+
+func (me *HttpHandler) libraryEntry(item libraryItem) (ret libraryEntry) {
+	ret.libraryItem = item
+	t, ok := me.torrentClient.Torrent(item.InfoHash)
+	if !ok {
+		return
+	}
+	ret.Name = t.Name()
+	if t.Info() != nil {
+		ret.InfoKnown = true
+		ret.BytesCompleted = t.BytesCompleted()
+		ret.Length = t.Length()
+		ret.Complete = t.Complete().Bool()
+	}
+	return
+}
+
+// GET lists the library. POST and PUT pin the torrent for the "link" form value.
+func (me *HttpHandler) handleLibrary(rw InstrumentedResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []libraryEntry{}
+		for _, item := range me.library.list() {
+			entries = append(entries, me.libraryEntry(item))
+		}
+		return encodeJsonResponse(rw, entries)
+	case http.MethodPost, http.MethodPut:
+	default:
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	link := r.FormValue("link")
+	m, err := metainfo.ParseMagnetUri(link)
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+	}
+	rw.Set("info_hash", m.InfoHash)
+	item := libraryItem{
+		InfoHash: m.InfoHash,
+		Link:     link,
+		Added:    time.Now(),
+	}
+	added, err := me.library.add(item)
+	if err != nil {
+		return errors.New("adding library item: %v", err)
+	}
+	if added {
+		if err := me.addLibraryTorrent(item); err != nil {
+			me.library.remove(item.InfoHash)
+			return errors.New("adding library torrent: %v", err)
+		}
+	} else {
+		item, _ = me.library.get(item.InfoHash)
+	}
+	return encodeJsonResponse(rw, me.libraryEntry(item))
+}
+
+// Unpins the torrent for the "link" form value, and deletes its data. Requires POST or DELETE.
+func (me *HttpHandler) handleLibraryRemove(rw InstrumentedResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost, http.MethodDelete:
+	default:
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	m, err := metainfo.ParseMagnetUri(r.FormValue("link"))
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+	}
+	rw.Set("info_hash", m.InfoHash)
+	if _, ok := me.library.get(m.InfoHash); !ok {
+		return handlerError{http.StatusNotFound, errors.New("%v is not in the library", m.InfoHash)}
+	}
+	_, err = me.library.remove(m.InfoHash)
+	if err != nil {
+		return errors.New("removing library item: %v", err)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestLibrary(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	link := *output.Link
+	m, err := metainfo.ParseMagnetUri(link)
+	require.NoError(t, err)
+	// Shared across restarts.
+	cacheDir := t.TempDir()
+	uploadsDir := t.TempDir()
+	newHandler := func(t *testing.T) *HttpHandler {
+		return newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+			input.CacheDir = cacheDir
+			input.RootUploadsDir = uploadsDir
+		})
+	}
+	request := func(handler *HttpHandler, method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	list := func(t *testing.T, handler *HttpHandler) (entries []libraryEntry) {
+		w := request(handler, http.MethodGet, "/library")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		return
+	}
+	waitComplete := func(t *testing.T, handler *HttpHandler) {
+		require.Eventually(t, func() bool {
+			entries := list(t, handler)
+			return len(entries) == 1 && entries[0].Complete
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	query := url.Values{"link": {link}}.Encode()
+
+	t.Run("Pin", func(t *testing.T) {
+		handler := newHandler(t)
+		assert.Empty(t, list(t, handler))
+		w := request(handler, http.MethodPost, "/library?"+query)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		waitComplete(t, handler)
+		entry := list(t, handler)[0]
+		assert.Equal(t, m.InfoHash, entry.InfoHash)
+		assert.EqualValues(t, len("file content"), entry.Length)
+		assert.DirExists(t, handler.library.dataDir(m.InfoHash))
+		assert.FileExists(t, handler.library.metainfoPath(m.InfoHash))
+		// An upload could be named anything, so the library can't be under upload storage.
+		rel, err := filepath.Rel(handler.dataDir, handler.library.dir)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(rel, ".."), rel)
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		// Everything must come from the library.
+		srv.SetFailureHook(func(*http.Request) int { return http.StatusServiceUnavailable })
+		defer srv.SetFailureHook(nil)
+		handler := newHandler(t)
+		waitComplete(t, handler)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		handler := newHandler(t)
+		w := request(handler, http.MethodPost, "/library/remove?"+query)
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Empty(t, list(t, handler))
+		assert.NoDirExists(t, handler.library.dataDir(m.InfoHash))
+		_, ok := handler.torrentClient.Torrent(m.InfoHash)
+		assert.False(t, ok)
+		w = request(handler, http.MethodPost, "/library/remove?"+query)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = request(handler, http.MethodGet, "/library/remove?"+query)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+
+	t.Run("PinWhileViewed", func(t *testing.T) {
+		handler := newHandler(t)
+		// As a view would.
+		viewed, _, release := handler.confluence.GetTorrent(m.InfoHash)
+		w := request(handler, http.MethodPost, "/library?"+query)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-viewed.Closed():
+			t.Fatal("viewed torrent was dropped")
+		default:
+		}
+		release()
+		select {
+		case <-viewed.Closed():
+		case <-time.After(10 * time.Second):
+			t.Fatal("viewed torrent wasn't replaced once released")
+		}
+		waitComplete(t, handler)
+		assert.DirExists(t, handler.library.dataDir(m.InfoHash))
+	})
+}
@@ -17,10 +17,40 @@ type objectInfo struct {
 	MimeTypes    []string  `json:"mimeTypes"`
 	LastModified time.Time `json:"lastModified"`
 	DisplayName  string    `json:"displayName"`
+	// Only set for multi-file uploads, in which case Link refers to the whole upload.
+	Files []objectFileInfo `json:"files,omitempty"`
+	// Only known for our own uploads.
+	Title             string   `json:"title,omitempty"`
+	Description       string   `json:"description,omitempty"`
+	Tags              []string `json:"tags,omitempty"`
+	Language          string   `json:"language,omitempty"`
+	License           string   `json:"license,omitempty"`
+	ContentCategories []string `json:"contentCategories,omitempty"`
+}
+
+func (me *objectInfo) setUploadOptions(uo service.UploadOptions) {
+	me.Title = uo.Title
+	me.Description = uo.Description
+	me.Tags = uo.Tags
+	me.Language = uo.Language
+	me.License = uo.License
+	me.ContentCategories = uo.ContentCategories
+}
+
+// A file within a multi-file upload.
+type objectFileInfo struct {
+	Link        string `json:"replicaLink"`
+	FileSize    int64  `json:"fileSize"`
+	MimeType    string `json:"mimeType"`
+	DisplayName string `json:"displayName"`
 }
 
 // Inits from a BitTorrent metainfo that must contain a valid info.
 func (me *objectInfo) FromUploadMetainfo(mi service.UploadMetainfo, lastModified time.Time) error {
+	if mi.IsMultiFile() {
+		me.fromMultiFileUploadMetainfo(mi, lastModified)
+		return nil
+	}
 	filePath := mi.FilePath()
 	*me = objectInfo{
 		FileSize:     mi.TotalLength(),
@@ -31,8 +61,59 @@ func (me *objectInfo) FromUploadMetainfo(mi service.UploadMetainfo, lastModified
 			if len(filePath) == 0 {
 				return nil
 			}
-			return []string{mime.TypeByExtension(path.Ext(filePath[len(filePath)-1]))}
+			return []string{mimeTypeForPath(filePath)}
 		}(),
 	}
 	return nil
 }
+
+func (me *objectInfo) fromMultiFileUploadMetainfo(mi service.UploadMetainfo, lastModified time.Time) {
+	filePaths := mi.FilePaths()
+	displayName := commonTopLevelDir(filePaths)
+	if displayName == "" {
+		displayName = mi.Info.BestName()
+	}
+	*me = objectInfo{
+		FileSize:     mi.TotalLength(),
+		LastModified: lastModified,
+		Link:         replica.CreateTorrentLink(mi.HashInfoBytes(), mi.Upload.Prefix, displayName),
+		DisplayName:  displayName,
+		MimeTypes:    []string{},
+	}
+	seenMimeTypes := make(map[string]bool)
+	for i, fi := range mi.Info.UpvertedFiles() {
+		filePath := filePaths[i]
+		mimeType := mimeTypeForPath(filePath)
+		me.Files = append(me.Files, objectFileInfo{
+			Link:        replica.CreateFileLink(mi.HashInfoBytes(), mi.Upload.Prefix, i, filePath),
+			FileSize:    fi.Length,
+			MimeType:    mimeType,
+			DisplayName: path.Join(filePath...),
+		})
+		if !seenMimeTypes[mimeType] {
+			seenMimeTypes[mimeType] = true
+			me.MimeTypes = append(me.MimeTypes, mimeType)
+		}
+	}
+}
+
+func mimeTypeForPath(filePath []string) string {
+	if len(filePath) == 0 {
+		return ""
+	}
+	return mime.TypeByExtension(path.Ext(filePath[len(filePath)-1]))
+}
+
+// Returns the directory all the paths are in, if there is one. This is what a directory upload will
+// look like.
+func commonTopLevelDir(paths [][]string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	for _, p := range paths {
+		if len(p) < 2 || p[0] != paths[0][0] {
+			return ""
+		}
+	}
+	return paths[0][0]
+}
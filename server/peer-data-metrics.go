@@ -0,0 +1,162 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/ops"
+)
+
+const (
+	// How often summarized peer data is exported while torrents are active.
+	peerDataFlushInterval = time.Minute
+	// Summaries kept between flushes. Going over flushes everything early, so memory stays bounded
+	// no matter how many torrents and peer kinds turn up.
+	maxPeerDataKeys = 4096
+)
+
+// What useful data from peers is summarized by.
+type peerDataKey struct {
+	infoHash metainfo.Hash
+	network  string
+	source   torrent.PeerSource
+}
+
+type peerDataTotals struct {
+	usefulBytes  int64
+	usefulChunks int64
+}
+
+// Sums useful data received from peers, instead of reporting every chunk, which can be thousands of
+// times a second on a fast download.
+type peerDataMetrics struct {
+	mu     sync.Mutex
+	totals map[peerDataKey]*peerDataTotals
+	// Torrents that are being watched for being dropped.
+	watched map[metainfo.Hash]struct{}
+	// Exports a summary. Replaced in tests.
+	emit func(peerDataKey, peerDataTotals)
+}
+
+func newPeerDataMetrics() *peerDataMetrics {
+	return &peerDataMetrics{
+		totals:  make(map[peerDataKey]*peerDataTotals),
+		watched: make(map[metainfo.Hash]struct{}),
+		emit:    emitPeerDataOp,
+	}
+}
+
+func emitPeerDataOp(key peerDataKey, totals peerDataTotals) {
+	op := ops.Begin("replica_torrent_peer_sent_data")
+	op.Set("info_hash", key.infoHash.HexString())
+	op.Set("remote_network", key.network)
+	op.Set("peer_source", peerSourceName(key.source))
+	op.Set("useful_bytes_count", float64(totals.usefulBytes))
+	op.Set("useful_chunks_count", float64(totals.usefulChunks))
+	op.End()
+}
+
+func peerSourceName(source torrent.PeerSource) string {
+	switch source {
+	case torrent.PeerSourceTracker:
+		return "tracker"
+	case torrent.PeerSourceDhtGetPeers, torrent.PeerSourceDhtAnnouncePeer:
+		return "dht"
+	case torrent.PeerSourceDirect:
+		return "direct"
+	case torrent.PeerSourcePex:
+		return "pex"
+	case torrent.PeerSourceIncoming:
+		return "incoming"
+	case torrent.PeerSourceUtHolepunch:
+		return "holepunch"
+	case "":
+		return "unknown"
+	default:
+		return string(source)
+	}
+}
+
+// Handles the torrent client's ReceivedUsefulData callback. This is called with the client locked,
+// so it mustn't do much.
+func (me *peerDataMetrics) receivedUsefulData(event torrent.ReceivedUsefulDataEvent) {
+	t := event.Peer.Torrent()
+	if me.add(peerDataKey{t.InfoHash(), event.Peer.Network, event.Peer.Discovery}, len(event.Message.Piece)) {
+		go func() {
+			<-t.Closed()
+			me.flushInfoHash(t.InfoHash())
+		}()
+	}
+}
+
+// Returns true if this is the first data for the torrent since it was last flushed on being
+// dropped, in which case the caller should arrange for flushInfoHash when it is.
+func (me *peerDataMetrics) add(key peerDataKey, n int) (watch bool) {
+	me.mu.Lock()
+	if len(me.totals) >= maxPeerDataKeys {
+		if _, ok := me.totals[key]; !ok {
+			full := me.totals
+			me.totals = make(map[peerDataKey]*peerDataTotals)
+			// Not while holding the torrent client lock.
+			go me.emitAll(full)
+		}
+	}
+	totals, ok := me.totals[key]
+	if !ok {
+		totals = &peerDataTotals{}
+		me.totals[key] = totals
+	}
+	totals.usefulBytes += int64(n)
+	totals.usefulChunks++
+	if _, watch = me.watched[key.infoHash]; !watch {
+		me.watched[key.infoHash] = struct{}{}
+	}
+	me.mu.Unlock()
+	return !watch
+}
+
+func (me *peerDataMetrics) emitAll(totals map[peerDataKey]*peerDataTotals) {
+	for key, t := range totals {
+		me.emit(key, *t)
+	}
+}
+
+// Exports everything summarized so far.
+func (me *peerDataMetrics) flush() {
+	me.mu.Lock()
+	totals := me.totals
+	me.totals = make(map[peerDataKey]*peerDataTotals)
+	me.mu.Unlock()
+	me.emitAll(totals)
+}
+
+// Exports what's summarized for a torrent, such as when it's dropped.
+func (me *peerDataMetrics) flushInfoHash(ih metainfo.Hash) {
+	totals := make(map[peerDataKey]*peerDataTotals)
+	me.mu.Lock()
+	for key, t := range me.totals {
+		if key.infoHash == ih {
+			totals[key] = t
+			delete(me.totals, key)
+		}
+	}
+	delete(me.watched, ih)
+	me.mu.Unlock()
+	me.emitAll(totals)
+}
+
+func (me *HttpHandler) peerDataExporter() {
+	for {
+		select {
+		case <-me.closed.Done():
+			return
+		case <-me.shuttingDown.Done():
+			// Close does the final flush.
+			return
+		case <-time.After(peerDataFlushInterval):
+			me.peerData.flush()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/ops"
+	"github.com/stretchr/testify/assert"
+)
+
+type emittedPeerData struct {
+	mu      sync.Mutex
+	emitted map[peerDataKey]peerDataTotals
+}
+
+func (me *emittedPeerData) emit(key peerDataKey, totals peerDataTotals) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	sum := me.emitted[key]
+	sum.usefulBytes += totals.usefulBytes
+	sum.usefulChunks += totals.usefulChunks
+	me.emitted[key] = sum
+}
+
+func (me *emittedPeerData) get() map[peerDataKey]peerDataTotals {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make(map[peerDataKey]peerDataTotals, len(me.emitted))
+	for k, v := range me.emitted {
+		ret[k] = v
+	}
+	return ret
+}
+
+func newTestPeerDataMetrics() (*peerDataMetrics, *emittedPeerData) {
+	emitted := &emittedPeerData{emitted: make(map[peerDataKey]peerDataTotals)}
+	pdm := newPeerDataMetrics()
+	pdm.emit = emitted.emit
+	return pdm, emitted
+}
+
+func TestPeerDataMetrics(t *testing.T) {
+	a := peerDataKey{metainfo.HashBytes([]byte("a")), "tcp", torrent.PeerSourceTracker}
+	aUtp := peerDataKey{a.infoHash, "udp", torrent.PeerSourceDhtGetPeers}
+	b := peerDataKey{metainfo.HashBytes([]byte("b")), "tcp", torrent.PeerSourceIncoming}
+
+	t.Run("Aggregate", func(t *testing.T) {
+		pdm, emitted := newTestPeerDataMetrics()
+		assert.True(t, pdm.add(a, 100))
+		assert.False(t, pdm.add(a, 50))
+		assert.False(t, pdm.add(aUtp, 10))
+		assert.True(t, pdm.add(b, 1))
+		assert.Empty(t, emitted.get())
+		pdm.flush()
+		assert.Equal(t, map[peerDataKey]peerDataTotals{
+			a:    {150, 2},
+			aUtp: {10, 1},
+			b:    {1, 1},
+		}, emitted.get())
+		// Nothing is emitted again.
+		pdm.flush()
+		assert.Len(t, emitted.get(), 3)
+	})
+
+	t.Run("FlushInfoHash", func(t *testing.T) {
+		pdm, emitted := newTestPeerDataMetrics()
+		pdm.add(a, 100)
+		pdm.add(aUtp, 10)
+		pdm.add(b, 1)
+		pdm.flushInfoHash(a.infoHash)
+		assert.Equal(t, map[peerDataKey]peerDataTotals{
+			a:    {100, 1},
+			aUtp: {10, 1},
+		}, emitted.get())
+		// The torrent could be added again, and would need watching.
+		assert.True(t, pdm.add(a, 1))
+		assert.False(t, pdm.add(b, 1))
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		pdm, emitted := newTestPeerDataMetrics()
+		for i := 0; i < maxPeerDataKeys+1; i++ {
+			pdm.add(peerDataKey{a.infoHash, "tcp", torrent.PeerSource(rune(i))}, 1)
+		}
+		pdm.mu.Lock()
+		assert.Len(t, pdm.totals, 1)
+		pdm.mu.Unlock()
+		assert.Eventually(t, func() bool {
+			return len(emitted.get()) == maxPeerDataKeys
+		}, time.Second, time.Millisecond)
+	})
+}
+
+// What the ReceivedUsefulData callback used to do for every chunk.
+func BenchmarkPeerDataPerChunkOps(b *testing.B) {
+	ih := metainfo.HashBytes([]byte("a"))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		op := ops.Begin("replica_torrent_peer_sent_data")
+		op.Set("remote_addr", "1.2.3.4:5678")
+		op.Set("remote_network", "tcp")
+		op.Set("useful_bytes_count", float64(16<<10))
+		op.Set("info_hash", ih.HexString())
+		op.End()
+	}
+}
+
+func BenchmarkPeerDataAggregated(b *testing.B) {
+	pdm := newPeerDataMetrics()
+	key := peerDataKey{metainfo.HashBytes([]byte("a")), "tcp", torrent.PeerSourceTracker}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pdm.add(key, 16<<10)
+	}
+	pdm.flush()
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Upper bounds in seconds of the request duration histogram buckets.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Counters exposed by a handler's /metrics.
+type metricsRegistry struct {
+	mu sync.Mutex
+	// By wrapHandlerError op name.
+	routes map[string]*routeMetrics
+	// By source host.
+	sourceWins     map[string]int64
+	sourceFailures map[string]int64
+	// By result.
+	uploads         map[string]int64
+	uploadBytesSent atomic.Int64
+}
+
+type routeMetrics struct {
+	successes int64
+	errors    int64
+	// Counts per bucket, not cumulative, with the last for requests beyond every bound.
+	bucketCounts []int64
+	durationSum  float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		routes:         make(map[string]*routeMetrics),
+		sourceWins:     make(map[string]int64),
+		sourceFailures: make(map[string]int64),
+		uploads:        make(map[string]int64),
+	}
+}
+
+func (me *metricsRegistry) recordRequest(route string, failed bool, d time.Duration) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	rm, ok := me.routes[route]
+	if !ok {
+		rm = &routeMetrics{bucketCounts: make([]int64, len(requestDurationBuckets)+1)}
+		me.routes[route] = rm
+	}
+	if failed {
+		rm.errors++
+	} else {
+		rm.successes++
+	}
+	seconds := d.Seconds()
+	rm.bucketCounts[sort.SearchFloat64s(requestDurationBuckets, seconds)]++
+	rm.durationSum += seconds
+}
+
+// Records whether a doFirst source was the one used. Sources are reduced to their hosts, to keep
+// the number of series down.
+func (me *metricsRegistry) recordSource(source string, won bool) {
+	host := source
+	if u, err := url.Parse(source); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if won {
+		me.sourceWins[host]++
+	} else {
+		me.sourceFailures[host]++
+	}
+}
+
+func (me *metricsRegistry) recordUpload(failed bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if failed {
+		me.uploads["failure"]++
+	} else {
+		me.uploads["success"]++
+	}
+}
+
+var metricLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+type metricLabel struct {
+	name, value string
+}
+
+func (me *metricsWriter) family(name, typ, help string) {
+	me.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (me *metricsWriter) sample(name string, value float64, labels ...metricLabel) {
+	me.printf("%s", name)
+	if len(labels) != 0 {
+		me.printf("{")
+		for i, l := range labels {
+			if i != 0 {
+				me.printf(",")
+			}
+			me.printf("%s=\"%s\"", l.name, metricLabelValueEscaper.Replace(l.value))
+		}
+		me.printf("}")
+	}
+	me.printf(" %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (me *metricsWriter) printf(format string, args ...any) {
+	if me.err == nil {
+		_, me.err = fmt.Fprintf(me.w, format, args...)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) (ret []string) {
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return
+}
+
+func (me *metricsRegistry) write(mw *metricsWriter) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	routes := sortedKeys(me.routes)
+	mw.family("replica_http_requests_total", "counter", "Requests handled, by route and whether they failed.")
+	for _, route := range routes {
+		rm := me.routes[route]
+		mw.sample("replica_http_requests_total", float64(rm.successes), metricLabel{"route", route}, metricLabel{"result", "success"})
+		mw.sample("replica_http_requests_total", float64(rm.errors), metricLabel{"route", route}, metricLabel{"result", "error"})
+	}
+	mw.family("replica_http_request_duration_seconds", "histogram", "Time taken to handle requests, by route.")
+	for _, route := range routes {
+		rm := me.routes[route]
+		var cumulative int64
+		for i, bound := range requestDurationBuckets {
+			cumulative += rm.bucketCounts[i]
+			mw.sample("replica_http_request_duration_seconds_bucket", float64(cumulative),
+				metricLabel{"route", route}, metricLabel{"le", strconv.FormatFloat(bound, 'g', -1, 64)})
+		}
+		count := cumulative + rm.bucketCounts[len(requestDurationBuckets)]
+		mw.sample("replica_http_request_duration_seconds_bucket", float64(count), metricLabel{"route", route}, metricLabel{"le", "+Inf"})
+		mw.sample("replica_http_request_duration_seconds_sum", rm.durationSum, metricLabel{"route", route})
+		mw.sample("replica_http_request_duration_seconds_count", float64(count), metricLabel{"route", route})
+	}
+	mw.family("replica_source_wins_total", "counter", "Times a source was the one used when several were tried at once.")
+	for _, host := range sortedKeys(me.sourceWins) {
+		mw.sample("replica_source_wins_total", float64(me.sourceWins[host]), metricLabel{"host", host})
+	}
+	mw.family("replica_source_failures_total", "counter", "Times a source failed or gave an unusable response when several were tried at once.")
+	for _, host := range sortedKeys(me.sourceFailures) {
+		mw.sample("replica_source_failures_total", float64(me.sourceFailures[host]), metricLabel{"host", host})
+	}
+	mw.family("replica_uploads_total", "counter", "Uploads to the Replica service, by result.")
+	for _, result := range []string{"success", "failure"} {
+		mw.sample("replica_uploads_total", float64(me.uploads[result]), metricLabel{"result", result})
+	}
+	mw.family("replica_upload_sent_bytes_total", "counter", "Bytes sent to the Replica service for uploads.")
+	mw.sample("replica_upload_sent_bytes_total", float64(me.uploadBytesSent.Load()))
+}
+
+// Converts a Go field name like BytesReadUsefulData to bytes_read_useful_data.
+func snakeCaseMetricName(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i != 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func (me *HttpHandler) writeTorrentClientMetrics(mw *metricsWriter) {
+	mw.family("replica_torrent_client_torrents", "gauge", "Torrents in the torrent client.")
+	mw.sample("replica_torrent_client_torrents", float64(len(me.torrentClient.Torrents())))
+	// Counts come through as int64, and are cumulative. Other numbers are current values.
+	walkFieldsForMetrics(
+		func(path []string, value any) {
+			components := []string{"replica_torrent_client"}
+			for _, p := range path {
+				components = append(components, snakeCaseMetricName(p))
+			}
+			name := strings.Join(components, "_")
+			help := "Torrent client stat " + strings.Join(path, ".") + "."
+			switch v := value.(type) {
+			case int64:
+				mw.family(name+"_total", "counter", help)
+				mw.sample(name+"_total", float64(v))
+			default:
+				rv := reflect.ValueOf(value)
+				switch {
+				case rv.CanInt():
+					mw.family(name, "gauge", help)
+					mw.sample(name, float64(rv.Int()))
+				case rv.CanUint():
+					mw.family(name, "gauge", help)
+					mw.sample(name, float64(rv.Uint()))
+				case rv.CanFloat():
+					mw.family(name, "gauge", help)
+					mw.sample(name, rv.Float())
+				}
+			}
+		},
+		reflect.ValueOf(me.torrentClient.Stats()),
+		nil,
+	)
+}
+
+func (me *HttpHandler) writeStorageCacheMetrics(mw *metricsWriter) {
+	if me.storageCache == nil {
+		return
+	}
+	mw.family("replica_storage_cache_capacity_bytes", "gauge", "Capacity of the view storage cache. Zero or less is unlimited.")
+	mw.sample("replica_storage_cache_capacity_bytes", float64(me.storageCache.capacity))
+	mw.family("replica_storage_cache_disk_bytes", "gauge", "Size of the view storage cache database files.")
+	mw.sample("replica_storage_cache_disk_bytes", float64(me.storageCache.diskBytes()))
+	mw.family("replica_storage_cache_hits_total", "counter", "Pieces that were already cached when first checked.")
+	mw.sample("replica_storage_cache_hits_total", float64(me.storageCache.hits.Load()))
+	mw.family("replica_storage_cache_misses_total", "counter", "Pieces that were downloaded into the cache.")
+	mw.sample("replica_storage_cache_misses_total", float64(me.storageCache.misses.Load()))
+}
+
+func (me *HttpHandler) writeMetrics(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	me.metrics.write(mw)
+	me.writeTorrentClientMetrics(mw)
+	me.writeStorageCacheMetrics(mw)
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// Exposes metrics for Prometheus to scrape.
+func (me *HttpHandler) handleMetrics(rw InstrumentedResponseWriter, r *http.Request) error {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := me.writeMetrics(rw)
+	if err != nil {
+		return encoderWriterError{err}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		input.ServeMetrics = true
+	})
+	request := func(method, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	query := url.Values{"link": {*output.Link}}.Encode()
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/view?"+query, "").Code)
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/object_info?"+url.Values{"replicaLink": {*output.Link}}.Encode(), "").Code)
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/upload?name=other.txt", "other content").Code)
+
+	webseedUrl, err := url.Parse(srv.WebseedBaseUrl())
+	require.NoError(t, err)
+
+	w := request(http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	body := w.Body.String()
+	for _, want := range []string{
+		`replica_http_requests_total{route="replica_view",result="success"} `,
+		`replica_http_request_duration_seconds_bucket{route="replica_view",le="+Inf"} `,
+		`replica_http_request_duration_seconds_count{route="replica_view"} `,
+		`replica_source_wins_total{host="` + webseedUrl.Host + `"} `,
+		`replica_uploads_total{result="success"} `,
+		"replica_upload_sent_bytes_total ",
+		"replica_torrent_client_torrents ",
+		"replica_torrent_client_conn_stats_bytes_read_useful_data_total ",
+		"replica_torrent_client_active_half_open_attempts ",
+		"replica_storage_cache_hits_total ",
+		"replica_storage_cache_misses_total ",
+	} {
+		assert.Contains(t, body, want)
+	}
+	sampleRegexp := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_]+="[^"]*"(,[a-zA-Z_]+="[^"]*")*\})? \S+$`)
+	typed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			name := strings.Fields(line)[2]
+			assert.False(t, typed[name], "duplicate family %q", name)
+			typed[name] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		assert.Regexp(t, sampleRegexp, line)
+	}
+
+	handler = newServicetestHandler(t, srv, nil)
+	// Counters are per handler.
+	assert.Empty(t, handler.metrics.routes)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}
+
+func TestDoFirstSourceMetrics(t *testing.T) {
+	failedHit := make(chan struct{})
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(failedHit)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer failed.Close()
+	won := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Answer after the failure, so it arrives before a winner.
+		<-failedHit
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer won.Close()
+	slowCancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(slowCancelled)
+	}))
+	defer slow.Close()
+	metrics := newMetricsRegistry()
+	resp, err := doFirst(
+		(&http.Request{Method: http.MethodGet}).WithContext(context.Background()),
+		http.DefaultClient,
+		metrics,
+		func(r *http.Response) bool { return r.StatusCode == http.StatusOK },
+		[]string{failed.URL + "/", won.URL + "/", slow.URL + "/"},
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	<-slowCancelled
+	host := func(s string) string {
+		u, err := url.Parse(s)
+		require.NoError(t, err)
+		return u.Host
+	}
+	sources := func() (wins, failures map[string]int64) {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return maps.Clone(metrics.sourceWins), maps.Clone(metrics.sourceFailures)
+	}
+	require.Eventually(t, func() bool {
+		_, failures := sources()
+		return failures[host(failed.URL)] == 1
+	}, time.Second, time.Millisecond)
+	// The slow source was only cancelled because another won.
+	assert.Never(t, func() bool {
+		_, failures := sources()
+		return failures[host(slow.URL)] != 0
+	}, 100*time.Millisecond, time.Millisecond)
+	wins, _ := sources()
+	assert.Equal(t, map[string]int64{host(won.URL): 1}, wins)
+}
+
+func TestSnakeCaseMetricName(t *testing.T) {
+	for in, out := range map[string]string{
+		"BytesReadUsefulData":     "bytes_read_useful_data",
+		"ConnStats":               "conn_stats",
+		"ActiveHalfOpenAttempts":  "active_half_open_attempts",
+		"HTTPRequests":            "http_requests",
+		"NumPeersDialedAfter2Way": "num_peers_dialed_after2_way",
+	} {
+		assert.Equal(t, out, snakeCaseMetricName(in))
+	}
+}
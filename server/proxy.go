@@ -1,16 +1,22 @@
 package server
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
+
+	"github.com/getlantern/replica/service"
 )
 
 type proxyTransport struct {
 	// Satisfies http.RoundTripper
 	client *http.Client
+	// Provides the endpoints to send requests to, and tracks their health.
+	serviceClient service.ServiceClient
 }
 
 func (pt *proxyTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
@@ -29,7 +35,28 @@ func (pt *proxyTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 	}
 
 	req.Header.Del("Origin")
-	resp, err = pt.client.Do(req)
+	endpoints := pt.serviceClient.Endpoints()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Only safe requests are sent more than once.
+		endpoints = endpoints[:1]
+	}
+	for i, endpoint := range endpoints {
+		endpointReq := req.Clone(req.Context())
+		endpointReq.URL = endpoint.ResolveReference(req.URL)
+		log.Debugf("final request url: %q", endpointReq.URL)
+		started := time.Now()
+		resp, err = pt.client.Do(endpointReq)
+		respErr := service.ResponseError(resp, err)
+		pt.serviceClient.EndpointHealth.Observe(endpoint, time.Since(started), respErr)
+		var serviceErr *service.Error
+		if i == len(endpoints)-1 || !errors.As(respErr, &serviceErr) || !serviceErr.Retryable {
+			break
+		}
+		log.Debugf("failing over from %v: %v", endpoint, respErr)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
 	if err != nil {
 		log.Errorf("Could not issue HTTP request: %v", err)
 		return
@@ -37,18 +64,19 @@ func (pt *proxyTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 	return
 }
 
-func prepareRequest(r *http.Request, input NewHttpHandlerInput, serviceUrl func() *url.URL) {
+// Prepares the request for the service. The URL is left relative, and is resolved against each
+// service endpoint in turn by proxyTransport.
+func prepareRequest(r *http.Request, input NewHttpHandlerInput) {
 	// The Iran region endpoint tries to redirect to https, and our proxy handler doesn't follow
 	// redirects. I'm not sure why we were clobbering to "http" before. We need to make sure this
 	// works regardless of region.
 	log.Debugf("request url: %#v", r.URL)
 	log.Debugf("request url path: %q", r.URL.Path)
 
-	r.URL = serviceUrl().ResolveReference(&url.URL{
+	r.URL = &url.URL{
 		Path:     r.URL.Path,
 		RawQuery: r.URL.RawQuery,
-	})
-	log.Debugf("final request url: %q", r.URL)
+	}
 	r.RequestURI = "" // http: Request.RequestURI can't be set in client requests.
 
 	input.AddCommonHeaders(r)
@@ -64,9 +92,10 @@ func proxyHandler(input NewHttpHandlerInput, modifyResponse func(*http.Response)
 					return http.ErrUseLastResponse
 				},
 			},
+			serviceClient: input.ReplicaServiceClient,
 		},
 		Director: func(r *http.Request) {
-			prepareRequest(r, input, input.ReplicaServiceClient.ReplicaServiceEndpoint)
+			prepareRequest(r, input)
 		},
 		ModifyResponse: modifyResponse,
 	}
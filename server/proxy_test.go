@@ -1,10 +1,12 @@
 package server
 
 import (
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -14,6 +16,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
 )
 
 func TestProxy(t *testing.T) {
@@ -102,3 +105,33 @@ func (m *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	}
 	return resp, nil
 }
+
+func TestProxyFailover(t *testing.T) {
+	down := servicetest.NewServer()
+	defer down.Close()
+	down.SetFailureHook(servicetest.FailRequests("/", http.StatusServiceUnavailable, 0))
+	up := servicetest.NewServer()
+	defer up.Close()
+	_, err := up.ServiceClient().Upload(strings.NewReader("meow"), "cats.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	input := &NewHttpHandlerInput{
+		ReplicaServiceClient: service.ServiceClient{
+			ReplicaServiceEndpoints: func() []*url.URL { return []*url.URL{down.Endpoint(), up.Endpoint()} },
+			EndpointHealth:          &service.EndpointHealth{},
+		},
+		HttpClient: http.DefaultClient,
+	}
+	input.SetDefaults()
+	handler := proxyHandler(*input, func(*http.Response) error { return nil })
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/search?s=cats", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var results []servicetest.SearchResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+		require.Len(t, results, 1)
+		assert.Equal(t, "cats.txt", results[0].DisplayName)
+	}
+	assert.Equal(t, []*url.URL{up.Endpoint(), down.Endpoint()}, input.ReplicaServiceClient.Endpoints())
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/time/rate"
+)
+
+// The torrent client needs the upload burst to fit a whole chunk, and limits reads to the download
+// burst.
+const rateLimiterBurst = 256 << 10
+
+// Bandwidth limits in bytes per second. Zero is unlimited.
+type RateLimits struct {
+	Upload   int64 `json:"uploadRateLimit"`
+	Download int64 `json:"downloadRateLimit"`
+}
+
+func newRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, rateLimiterBurst)
+	setRateLimit(l, bytesPerSecond)
+	return l
+}
+
+func setRateLimit(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+	} else {
+		l.SetLimit(rate.Limit(bytesPerSecond))
+	}
+}
+
+func rateLimit(l *rate.Limiter) int64 {
+	if l.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(math.Round(float64(l.Limit())))
+}
+
+// The bandwidth limits currently in effect.
+func (me *HttpHandler) RateLimits() RateLimits {
+	return RateLimits{
+		Upload:   rateLimit(me.uploadRateLimiter),
+		Download: rateLimit(me.downloadRateLimiter),
+	}
+}
+
+// Changes the bandwidth limits for the torrent client and uploads to the Replica service. This
+// applies to transfers already in progress.
+func (me *HttpHandler) SetRateLimits(limits RateLimits) error {
+	if limits.Upload < 0 || limits.Download < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	setRateLimit(me.uploadRateLimiter, limits.Upload)
+	setRateLimit(me.downloadRateLimiter, limits.Download)
+	return nil
+}
+
+// GET returns the settings. POST and PUT change those given as form values, and return the result.
+func (me *HttpHandler) handleSettings(rw InstrumentedResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodOptions:
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		err := r.ParseForm()
+		if err != nil {
+			return handlerError{http.StatusBadRequest, errors.New("parsing form: %v", err)}
+		}
+		limits := me.RateLimits()
+		for key, field := range map[string]*int64{
+			"uploadRateLimit":   &limits.Upload,
+			"downloadRateLimit": &limits.Download,
+		} {
+			if !r.Form.Has(key) {
+				continue
+			}
+			*field, err = strconv.ParseInt(r.Form.Get(key), 10, 64)
+			if err != nil {
+				return handlerError{http.StatusBadRequest, errors.New("parsing %v: %v", key, err)}
+			}
+		}
+		if err := me.SetRateLimits(limits); err != nil {
+			return handlerError{http.StatusBadRequest, err}
+		}
+		rw.Set("upload_rate_limit", limits.Upload)
+		rw.Set("download_rate_limit", limits.Download)
+	default:
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	return encodeJsonResponse(rw, me.RateLimits())
+}
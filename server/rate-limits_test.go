@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestSettingsRateLimits(t *testing.T) {
+	handler := HttpHandler{
+		uploadRateLimiter:   newRateLimiter(0),
+		downloadRateLimiter: newRateLimiter(1 << 20),
+	}
+	settings := func(method string, form url.Values) (RateLimits, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/settings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		err := handler.handleSettings(&NoopInstrumentedResponseWriter{w}, r)
+		var limits RateLimits
+		if err == nil {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &limits))
+		}
+		return limits, err
+	}
+
+	// CORS preflight.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodOptions, "/settings", nil)
+	require.NoError(t, handler.handleSettings(&NoopInstrumentedResponseWriter{w}, r))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	limits, err := settings(http.MethodGet, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RateLimits{Upload: 0, Download: 1 << 20}, limits)
+
+	limits, err = settings(http.MethodPost, url.Values{"uploadRateLimit": {"65536"}})
+	require.NoError(t, err)
+	assert.Equal(t, RateLimits{Upload: 65536, Download: 1 << 20}, limits)
+	assert.Equal(t, rate.Limit(65536), handler.uploadRateLimiter.Limit())
+
+	limits, err = settings(http.MethodPost, url.Values{"downloadRateLimit": {"0"}})
+	require.NoError(t, err)
+	assert.Equal(t, RateLimits{Upload: 65536, Download: 0}, limits)
+	assert.Equal(t, rate.Inf, handler.downloadRateLimiter.Limit())
+
+	var he handlerError
+	_, err = settings(http.MethodPost, url.Values{"uploadRateLimit": {"-1"}})
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+	_, err = settings(http.MethodPost, url.Values{"uploadRateLimit": {"fast"}})
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+	assert.Equal(t, RateLimits{Upload: 65536, Download: 0}, handler.RateLimits())
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// How long Shutdown waits for work to unwind after cancelling it, so that state like the upload
+// queue is left consistent.
+const shutdownCancelGrace = 5 * time.Second
+
+// Work that Shutdown waits for. Once stopped, nothing new can start.
+type activities struct {
+	mu      sync.Mutex
+	stopped bool
+	nextId  int
+	active  map[int]string
+	// Closed and replaced whenever something finishes.
+	changed chan struct{}
+}
+
+// Returns false if the activities are stopped. Otherwise done must be called when the activity
+// finishes.
+func (me *activities) start(desc string) (done func(), ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.stopped {
+		return nil, false
+	}
+	if me.active == nil {
+		me.active = make(map[int]string)
+	}
+	id := me.nextId
+	me.nextId++
+	me.active[id] = desc
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			me.mu.Lock()
+			defer me.mu.Unlock()
+			delete(me.active, id)
+			if me.changed != nil {
+				close(me.changed)
+				me.changed = nil
+			}
+		})
+	}, true
+}
+
+// Runs f in a goroutine, unless the activities are stopped. Returns whether f was started.
+func (me *activities) goActivity(desc string, f func()) bool {
+	done, ok := me.start(desc)
+	if !ok {
+		return false
+	}
+	go func() {
+		defer done()
+		f()
+	}()
+	return true
+}
+
+func (me *activities) stop() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.stopped = true
+}
+
+// Waits for everything active to finish, or for ctx to be done.
+func (me *activities) wait(ctx context.Context) error {
+	for {
+		me.mu.Lock()
+		if len(me.active) == 0 {
+			me.mu.Unlock()
+			return nil
+		}
+		if me.changed == nil {
+			me.changed = make(chan struct{})
+		}
+		changed := me.changed
+		me.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Describes what's still active.
+func (me *activities) list() (ret []string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, desc := range me.active {
+		ret = append(ret, desc)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Tracks the request until it's done, and cancels its context if the handler is closed. Returns
+// false if the handler is shutting down.
+func (me *HttpHandler) startRequest(r *http.Request) (_ *http.Request, done func(), ok bool) {
+	requestDone, ok := me.requests.start(r.Method + " " + r.URL.Path)
+	if !ok {
+		return r, nil, false
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-me.closed.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return r.WithContext(ctx), func() {
+		cancel()
+		requestDone()
+	}, true
+}
+
+// Shutdown stops accepting requests and starting queued uploads, and waits for active requests,
+// the current upload and background work to finish. Whatever is left when ctx is done is
+// cancelled. Metrics are exported a final time, and the handler is closed. The error describes
+// anything that didn't finish.
+func (me *HttpHandler) Shutdown(ctx context.Context) error {
+	me.shuttingDown.Set()
+	me.requests.stop()
+	me.background.stop()
+	if me.uploadQueue != nil {
+		// So an idle worker notices.
+		me.uploadQueue.signal()
+	}
+	var unfinished []string
+	err := me.requests.wait(ctx)
+	if err == nil {
+		err = me.background.wait(ctx)
+	}
+	if err != nil {
+		unfinished = append(me.requests.list(), me.background.list()...)
+		if me.uploadQueue != nil {
+			if id := me.uploadQueue.currentId(); id != "" {
+				unfinished = append(unfinished, "queued upload "+id)
+			}
+		}
+		// Cancels the rest, which get a little longer to leave things tidy.
+		me.closed.Set()
+		graceCtx, cancel := context.WithTimeout(context.Background(), shutdownCancelGrace)
+		me.requests.wait(graceCtx)
+		me.background.wait(graceCtx)
+		cancel()
+	}
+	me.doMetricsOp()
+	me.Close()
+	if len(unfinished) != 0 {
+		return errors.New("%v: cancelled %v unfinished: %v", err, len(unfinished), strings.Join(unfinished, ", "))
+	}
+	return nil
+}
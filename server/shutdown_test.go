@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	stdErrors "errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestShutdown(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+
+	t.Run("Idle", func(t *testing.T) {
+		handler := newServicetestHandler(t, srv, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, handler.Shutdown(ctx))
+		assert.Empty(t, handler.background.list())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/heartbeat", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("UploadProgressStream", func(t *testing.T) {
+		handler := newServicetestHandler(t, srv, nil)
+		up, err := handler.uploadProgress.start("xyz", -1)
+		require.NoError(t, err)
+		up.setPhase(uploadPhaseUploading)
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/upload/progress?uploadId=xyz", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// The stream ends instead of holding up the shutdown.
+		require.NoError(t, handler.Shutdown(ctx))
+		_, err = io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+			input.MetadataTimeout = time.Hour
+		})
+		// Nothing has the info for this, so the view waits for it.
+		m := metainfo.Magnet{InfoHash: metainfo.HashBytes([]byte("unknown"))}
+		viewed := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/view?"+url.Values{"link": {m.String()}}.Encode(), nil))
+			viewed <- w.Code
+		}()
+		require.Eventually(t, func() bool {
+			return len(handler.requests.list()) != 0
+		}, 10*time.Second, time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := handler.Shutdown(ctx)
+		require.Error(t, err)
+		assert.True(t, stdErrors.Is(err, context.DeadlineExceeded), err)
+		assert.Contains(t, err.Error(), "GET /view")
+		select {
+		case code := <-viewed:
+			assert.NotEqual(t, http.StatusOK, code)
+		case <-time.After(shutdownCancelGrace):
+			t.Fatal("view wasn't cancelled")
+		}
+	})
+}
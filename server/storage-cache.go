@@ -0,0 +1,576 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	stdErrors "errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/squirrel"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
+	"github.com/getlantern/errors"
+)
+
+const defaultStorageCacheCapacity = 5 << 30
+
+// How long a listing of the cached torrents is reused if nothing changes. Sqlite evicts pieces
+// itself when the cache is full, which isn't seen as a change.
+const storageCacheListingMaxAge = 10 * time.Second
+
+// The sqlite piece cache for torrents that aren't uploads or in the library. It's kept across
+// restarts, and the infos of the torrents it has opened are saved so that what's cached can be
+// listed and evicted. Pieces are stored by hash, so torrents can share them.
+type storageCache struct {
+	path     string
+	infosDir string
+	capacity int64
+
+	mu    sync.RWMutex
+	cache *squirrel.Cache
+	impl  storage.ClientImpl
+	// Counts of open storage for each torrent.
+	open map[metainfo.Hash]int
+
+	// Pieces that were already cached when first checked, and pieces that were downloaded into the
+	// cache.
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	// Counts changes to what's cached, or which torrents have it open, to know when listing is
+	// stale.
+	changes   atomic.Int64
+	listingMu sync.Mutex
+	listing   *storageCacheListing
+}
+
+type storageCacheListing struct {
+	torrents  []storageCacheTorrent
+	usedBytes int64
+	changes   int64
+	at        time.Time
+}
+
+type storageCacheStats struct {
+	// Zero or less is unlimited.
+	Capacity int64 `json:"capacity"`
+	// Bytes of verified pieces for the known torrents.
+	UsedBytes int64 `json:"usedBytes"`
+	// Size of the database files, which includes incomplete pieces and sqlite overhead.
+	DiskBytes int64   `json:"diskBytes"`
+	Torrents  int     `json:"torrents"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hitRate"`
+}
+
+type storageCacheTorrent struct {
+	InfoHash     metainfo.Hash `json:"infoHash"`
+	Name         string        `json:"name"`
+	Length       int64         `json:"length"`
+	NumPieces    int           `json:"numPieces"`
+	CachedPieces int           `json:"cachedPieces"`
+	CachedBytes  int64         `json:"cachedBytes"`
+	// The torrent currently has the cache open.
+	Active bool `json:"active"`
+}
+
+// Opens the cache database at path, recreating it if it can't be opened.
+func openStorageCache(path string, capacity int64) (*storageCache, error) {
+	if capacity == 0 {
+		capacity = defaultStorageCacheCapacity
+	}
+	me := &storageCache{
+		path:     path,
+		infosDir: path + "-infos",
+		capacity: capacity,
+		open:     make(map[metainfo.Hash]int),
+	}
+	err := os.MkdirAll(me.infosDir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	err = me.openCache()
+	if err != nil {
+		log.Errorf("opening storage cache %q, recreating it: %v", path, err)
+		err = me.recreate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+func (me *storageCache) openCache() error {
+	var opts sqliteStorage.NewDirectStorageOpts
+	opts.Path = me.path
+	opts.Capacity = me.capacity
+	cache, err := squirrel.NewCache(opts)
+	if err != nil {
+		return err
+	}
+	me.cache = cache
+	me.impl = sqliteStorage.NewWrappingClient(cache)
+	return nil
+}
+
+// Throws away the database and the infos, and starts afresh. The cache must not be open.
+func (me *storageCache) recreate() error {
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := os.Remove(me.path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.RemoveAll(me.infosDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(me.infosDir, 0o700)
+	if err != nil {
+		return err
+	}
+	return me.openCache()
+}
+
+func (me *storageCache) infoPath(ih metainfo.Hash) string {
+	return filepath.Join(me.infosDir, ih.HexString()+".info")
+}
+
+func (me *storageCache) OpenTorrent(ctx context.Context, info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.impl == nil {
+		return storage.TorrentImpl{}, errors.New("storage cache is closed")
+	}
+	ti, err := me.impl.OpenTorrent(ctx, info, ih)
+	if err != nil {
+		return ti, err
+	}
+	if _, err := os.Stat(me.infoPath(ih)); os.IsNotExist(err) {
+		b, err := bencode.Marshal(info)
+		if err == nil {
+			err = os.WriteFile(me.infoPath(ih), b, 0o600)
+		}
+		if err != nil {
+			log.Errorf("saving storage cache info for %v: %v", ih, err)
+		}
+	}
+	me.open[ih]++
+	me.changes.Add(1)
+	t := &storageCacheOpenTorrent{cache: me, checked: make(map[int]bool)}
+	pieceWithHash := ti.PieceWithHash
+	ti.Piece = nil
+	ti.PieceWithHash = func(p metainfo.Piece, pieceHash g.Option[[]byte]) storage.PieceImpl {
+		return storageCachePiece{pieceWithHash(p, pieceHash), t, p.Index()}
+	}
+	innerClose := ti.Close
+	var closeOnce sync.Once
+	ti.Close = func() (err error) {
+		closeOnce.Do(func() {
+			me.mu.Lock()
+			if me.open[ih]--; me.open[ih] <= 0 {
+				delete(me.open, ih)
+			}
+			me.changes.Add(1)
+			me.mu.Unlock()
+			if innerClose != nil {
+				err = innerClose()
+			}
+		})
+		return
+	}
+	return ti, nil
+}
+
+func (me *storageCache) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		return nil
+	}
+	err := me.cache.Close()
+	me.cache = nil
+	me.impl = nil
+	return err
+}
+
+// Torrents that currently have storage open.
+func (me *storageCache) openInfoHashes() (ret []metainfo.Hash) {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+	for ih := range me.open {
+		ret = append(ret, ih)
+	}
+	return
+}
+
+func (me *storageCache) loadInfo(ih metainfo.Hash) (info metainfo.Info, err error) {
+	b, err := os.ReadFile(me.infoPath(ih))
+	if err != nil {
+		return
+	}
+	err = bencode.Unmarshal(b, &info)
+	return
+}
+
+// The infohashes of the saved infos.
+func (me *storageCache) infoHashes() (ret []metainfo.Hash, err error) {
+	entries, err := os.ReadDir(me.infosDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if filepath.Ext(name) != ".info" {
+			continue
+		}
+		var ih metainfo.Hash
+		if ih.FromHexString(name[:len(name)-len(".info")]) != nil {
+			continue
+		}
+		ret = append(ret, ih)
+	}
+	return
+}
+
+func pieceBlobName(p metainfo.Piece) (string, bool) {
+	h := p.V1Hash()
+	if !h.Ok {
+		return "", false
+	}
+	return hex.EncodeToString(h.Value[:]), true
+}
+
+// Lists the torrents with saved infos, and how much of each is cached. Torrents that have had all
+// their pieces evicted, and aren't open, are forgotten. Checking each piece is slow, so the last
+// listing is reused while it's fresh.
+func (me *storageCache) torrents() (ret []storageCacheTorrent, usedBytes int64, err error) {
+	me.listingMu.Lock()
+	defer me.listingMu.Unlock()
+	changes := me.changes.Load()
+	if l := me.listing; l != nil && l.changes == changes && time.Since(l.at) < storageCacheListingMaxAge {
+		return slices.Clone(l.torrents), l.usedBytes, nil
+	}
+	ret, usedBytes, err = me.listTorrents()
+	if err != nil {
+		return
+	}
+	me.listing = &storageCacheListing{
+		torrents:  slices.Clone(ret),
+		usedBytes: usedBytes,
+		changes:   changes,
+		at:        time.Now(),
+	}
+	return
+}
+
+func (me *storageCache) listTorrents() (ret []storageCacheTorrent, usedBytes int64, err error) {
+	ihs, err := me.infoHashes()
+	if err != nil {
+		return
+	}
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+	if me.cache == nil {
+		err = errors.New("storage cache is closed")
+		return
+	}
+	counted := make(map[string]bool)
+	for _, ih := range ihs {
+		info, err := me.loadInfo(ih)
+		if err != nil {
+			log.Errorf("loading storage cache info for %v: %v", ih, err)
+			continue
+		}
+		ct := storageCacheTorrent{
+			InfoHash:  ih,
+			Name:      info.BestName(),
+			Length:    info.TotalLength(),
+			NumPieces: info.NumPieces(),
+			Active:    me.open[ih] > 0,
+		}
+		for i := range ct.NumPieces {
+			p := info.Piece(i)
+			name, ok := pieceBlobName(p)
+			if !ok {
+				continue
+			}
+			var complete bool
+			err := me.cache.NewBlobRef(name).GetTag("verified", func(stmt squirrel.SqliteStmt) {
+				complete = stmt.ColumnInt(0) != 0
+			})
+			if err != nil || !complete {
+				continue
+			}
+			ct.CachedPieces++
+			ct.CachedBytes += p.Length()
+			if !counted[name] {
+				counted[name] = true
+				usedBytes += p.Length()
+			}
+		}
+		if ct.CachedPieces == 0 && !ct.Active {
+			os.Remove(me.infoPath(ih))
+			continue
+		}
+		ret = append(ret, ct)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].InfoHash.HexString() < ret[j].InfoHash.HexString()
+	})
+	return
+}
+
+func (me *storageCache) stats() (ret storageCacheStats, err error) {
+	torrents, usedBytes, err := me.torrents()
+	if err != nil {
+		return
+	}
+	ret.Capacity = me.capacity
+	ret.UsedBytes = usedBytes
+	ret.Torrents = len(torrents)
+	ret.DiskBytes = me.diskBytes()
+	ret.Hits = me.hits.Load()
+	ret.Misses = me.misses.Load()
+	if total := ret.Hits + ret.Misses; total != 0 {
+		ret.HitRate = float64(ret.Hits) / float64(total)
+	}
+	return
+}
+
+// The size of the database files.
+func (me *storageCache) diskBytes() (ret int64) {
+	for _, suffix := range []string{"", "-wal"} {
+		if fi, err := os.Stat(me.path + suffix); err == nil {
+			ret += fi.Size()
+		}
+	}
+	return
+}
+
+// The piece blobs used by the torrents with saved infos, other than except.
+func (me *storageCache) otherPieceBlobs(except metainfo.Hash) (map[string]bool, error) {
+	ihs, err := me.infoHashes()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, ih := range ihs {
+		if ih == except {
+			continue
+		}
+		info, err := me.loadInfo(ih)
+		if err != nil {
+			log.Errorf("loading storage cache info for %v: %v", ih, err)
+			continue
+		}
+		for i := range info.NumPieces() {
+			if name, ok := pieceBlobName(info.Piece(i)); ok {
+				ret[name] = true
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Deletes the cached pieces of a torrent, except those other cached torrents have too. The torrent
+// shouldn't have the cache open. Returns false if nothing was known about it.
+func (me *storageCache) evict(ih metainfo.Hash) (bool, error) {
+	info, err := me.loadInfo(ih)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	shared, err := me.otherPieceBlobs(ih)
+	if err != nil {
+		return true, err
+	}
+	defer me.changes.Add(1)
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+	if me.cache == nil {
+		return true, errors.New("storage cache is closed")
+	}
+	err = me.cache.Tx(func(tx *squirrel.Tx) error {
+		for i := range info.NumPieces() {
+			name, ok := pieceBlobName(info.Piece(i))
+			if !ok || shared[name] {
+				continue
+			}
+			err := tx.Delete(name)
+			if err != nil && !stdErrors.Is(err, squirrel.ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return true, err
+	}
+	return true, os.Remove(me.infoPath(ih))
+}
+
+// Deletes everything by recreating the database. Torrents shouldn't have the cache open.
+func (me *storageCache) purge() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.cache == nil {
+		return errors.New("storage cache is closed")
+	}
+	defer me.changes.Add(1)
+	err := me.cache.Close()
+	me.cache = nil
+	me.impl = nil
+	if err != nil {
+		log.Errorf("closing storage cache for purge: %v", err)
+	}
+	return me.recreate()
+}
+
+// Tracks which pieces of an open torrent have been counted as hits or misses.
+type storageCacheOpenTorrent struct {
+	cache *storageCache
+	mu    sync.Mutex
+	// Whether the piece was counted as a hit, or is waiting to be counted as a miss.
+	checked map[int]bool
+}
+
+type storageCachePiece struct {
+	storage.PieceImpl
+	t     *storageCacheOpenTorrent
+	index int
+}
+
+func (me storageCachePiece) Completion() storage.Completion {
+	c := me.PieceImpl.Completion()
+	if !c.Ok {
+		return c
+	}
+	me.t.mu.Lock()
+	defer me.t.mu.Unlock()
+	if _, ok := me.t.checked[me.index]; !ok {
+		me.t.checked[me.index] = c.Complete
+		if c.Complete {
+			me.t.cache.hits.Add(1)
+		}
+	}
+	return c
+}
+
+func (me storageCachePiece) MarkComplete() error {
+	err := me.PieceImpl.MarkComplete()
+	if err != nil {
+		return err
+	}
+	me.t.cache.changes.Add(1)
+	me.t.mu.Lock()
+	defer me.t.mu.Unlock()
+	if !me.t.checked[me.index] {
+		me.t.checked[me.index] = true
+		me.t.cache.misses.Add(1)
+	}
+	return nil
+}
+
+// Drops the torrents using the cache, so its data can be deleted. Views of them are interrupted.
+func (me *HttpHandler) dropStorageCacheTorrents(ihs ...metainfo.Hash) {
+	for _, ih := range ihs {
+		if t, ok := me.torrentClient.Torrent(ih); ok {
+			t.Drop()
+		}
+	}
+}
+
+func (me *HttpHandler) checkStorageCache() error {
+	if me.storageCache == nil {
+		return handlerError{http.StatusNotImplemented, errors.New("view storage isn't a sqlite cache")}
+	}
+	return nil
+}
+
+// Reports the cache usage and hit rates.
+func (me *HttpHandler) handleStorageCache(rw InstrumentedResponseWriter, r *http.Request) error {
+	if err := me.checkStorageCache(); err != nil {
+		return err
+	}
+	stats, err := me.storageCache.stats()
+	if err != nil {
+		return errors.New("getting storage cache stats: %v", err)
+	}
+	return encodeJsonResponse(rw, stats)
+}
+
+// Lists the torrents in the cache.
+func (me *HttpHandler) handleStorageCacheTorrents(rw InstrumentedResponseWriter, r *http.Request) error {
+	if err := me.checkStorageCache(); err != nil {
+		return err
+	}
+	torrents, _, err := me.storageCache.torrents()
+	if err != nil {
+		return errors.New("listing storage cache torrents: %v", err)
+	}
+	if torrents == nil {
+		torrents = []storageCacheTorrent{}
+	}
+	return encodeJsonResponse(rw, torrents)
+}
+
+// Deletes everything in the cache.
+func (me *HttpHandler) handleStorageCachePurge(rw InstrumentedResponseWriter, r *http.Request) error {
+	if err := me.checkStorageCache(); err != nil {
+		return err
+	}
+	if r.Method != http.MethodPost {
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	me.dropStorageCacheTorrents(me.storageCache.openInfoHashes()...)
+	err := me.storageCache.purge()
+	if err != nil {
+		return errors.New("purging storage cache: %v", err)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Deletes the cached data for the "infohash" form value.
+func (me *HttpHandler) handleStorageCacheEvict(rw InstrumentedResponseWriter, r *http.Request) error {
+	if err := me.checkStorageCache(); err != nil {
+		return err
+	}
+	if r.Method != http.MethodPost {
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	var ih metainfo.Hash
+	err := ih.FromHexString(r.FormValue("infohash"))
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing infohash: %v", err)}
+	}
+	rw.Set("info_hash", ih)
+	for _, open := range me.storageCache.openInfoHashes() {
+		if open == ih {
+			me.dropStorageCacheTorrents(ih)
+		}
+	}
+	found, err := me.storageCache.evict(ih)
+	if err != nil {
+		return errors.New("evicting %v from storage cache: %v", ih, err)
+	}
+	if !found {
+		return handlerError{http.StatusNotFound, errors.New("%v is not in the storage cache", ih)}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestStorageCache(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	link := *output.Link
+	m, err := metainfo.ParseMagnetUri(link)
+	require.NoError(t, err)
+	// Shared across restarts.
+	cacheDir := t.TempDir()
+	newHandler := func(t *testing.T) *HttpHandler {
+		return newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+			input.CacheDir = cacheDir
+		})
+	}
+	request := func(handler *HttpHandler, method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	viewLink := func(t *testing.T, handler *HttpHandler, link string) {
+		w := request(handler, http.MethodGet, "/view?"+url.Values{"link": {link}}.Encode())
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		b, err := io.ReadAll(w.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "file content", string(b))
+	}
+	view := func(t *testing.T, handler *HttpHandler) {
+		viewLink(t, handler, link)
+	}
+	stats := func(t *testing.T, handler *HttpHandler) (ret storageCacheStats) {
+		w := request(handler, http.MethodGet, "/cache")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		return
+	}
+	list := func(t *testing.T, handler *HttpHandler) (ret []storageCacheTorrent) {
+		w := request(handler, http.MethodGet, "/cache/torrents")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		return
+	}
+	var dbPath string
+	evictQuery := url.Values{"infohash": {m.InfoHash.HexString()}}.Encode()
+
+	t.Run("Fill", func(t *testing.T) {
+		handler := newHandler(t)
+		dbPath = handler.storageCache.path
+		view(t, handler)
+		s := stats(t, handler)
+		assert.EqualValues(t, defaultStorageCacheCapacity, s.Capacity)
+		assert.EqualValues(t, len("file content"), s.UsedBytes)
+		assert.EqualValues(t, 1, s.Torrents)
+		assert.Zero(t, s.Hits)
+		assert.NotZero(t, s.Misses)
+		torrents := list(t, handler)
+		require.Len(t, torrents, 1)
+		assert.Equal(t, m.InfoHash, torrents[0].InfoHash)
+		assert.Equal(t, torrents[0].NumPieces, torrents[0].CachedPieces)
+		assert.True(t, torrents[0].Active)
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		handler := newHandler(t)
+		torrents := list(t, handler)
+		require.Len(t, torrents, 1)
+		assert.False(t, torrents[0].Active)
+		view(t, handler)
+		s := stats(t, handler)
+		assert.NotZero(t, s.Hits)
+		assert.Zero(t, s.Misses)
+		assert.Equal(t, 1.0, s.HitRate)
+	})
+
+	t.Run("Evict", func(t *testing.T) {
+		handler := newHandler(t)
+		view(t, handler)
+		assert.Equal(t, http.StatusMethodNotAllowed, request(handler, http.MethodGet, "/cache/evict?"+evictQuery).Code)
+		w := request(handler, http.MethodPost, "/cache/evict?"+evictQuery)
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Empty(t, list(t, handler))
+		assert.Zero(t, stats(t, handler).UsedBytes)
+		assert.Equal(t, http.StatusNotFound, request(handler, http.MethodPost, "/cache/evict?"+evictQuery).Code)
+		// It's downloaded again.
+		view(t, handler)
+		assert.Len(t, list(t, handler), 1)
+	})
+
+	t.Run("EvictShared", func(t *testing.T) {
+		// The same content in another torrent has the same pieces.
+		other, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "other.txt", service.UploadOptions{})
+		require.NoError(t, err)
+		otherMagnet, err := metainfo.ParseMagnetUri(*other.Link)
+		require.NoError(t, err)
+		handler := newHandler(t)
+		view(t, handler)
+		viewLink(t, handler, *other.Link)
+		require.Len(t, list(t, handler), 2)
+		w := request(handler, http.MethodPost, "/cache/evict?"+evictQuery)
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		torrents := list(t, handler)
+		require.Len(t, torrents, 1)
+		assert.Equal(t, otherMagnet.InfoHash, torrents[0].InfoHash)
+		assert.Equal(t, torrents[0].NumPieces, torrents[0].CachedPieces)
+		assert.EqualValues(t, len("file content"), stats(t, handler).UsedBytes)
+		otherQuery := url.Values{"infohash": {otherMagnet.InfoHash.HexString()}}.Encode()
+		w = request(handler, http.MethodPost, "/cache/evict?"+otherQuery)
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Zero(t, stats(t, handler).UsedBytes)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		handler := newHandler(t)
+		view(t, handler)
+		w := request(handler, http.MethodPost, "/cache/purge")
+		require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Empty(t, list(t, handler))
+		view(t, handler)
+		assert.Len(t, list(t, handler), 1)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		require.FileExists(t, dbPath)
+		require.NoError(t, os.WriteFile(dbPath, []byte(strings.Repeat("not a database", 1000)), 0o600))
+		handler := newHandler(t)
+		assert.Empty(t, list(t, handler))
+		view(t, handler)
+		assert.Len(t, list(t, handler), 1)
+	})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/squirrel"
+	"github.com/anacrolix/torrent/storage"
+	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
+)
+
+// Creates the torrent storage for one of the handler's roles. The directory is for the role's
+// exclusive use, and exists.
+type StorageFactory func(dir string) (storage.ClientImplCloser, error)
+
+// Stores torrent files as they're laid out in the torrent, beneath the directory.
+func FileStorage() StorageFactory {
+	return func(dir string) (storage.ClientImplCloser, error) {
+		return storage.NewFile(dir), nil
+	}
+}
+
+// Like FileStorage, but each torrent is kept beneath a directory named for its infohash, so torrents
+// with the same names don't collide.
+func FileByInfoHashStorage() StorageFactory {
+	return func(dir string) (storage.ClientImplCloser, error) {
+		return storage.NewFileByInfoHash(dir), nil
+	}
+}
+
+// Memory-maps torrent files, laid out as with FileStorage. Can be faster than sqlite on devices
+// with slow sqlite.
+func MMapStorage() StorageFactory {
+	return func(dir string) (storage.ClientImplCloser, error) {
+		return storage.NewMMap(dir), nil
+	}
+}
+
+// A sqlite database in the directory that holds at most capacity bytes, evicting the least
+// recently used pieces. Zero is the default of 5 GiB, and less than zero is unlimited. When used for
+// views, the cache endpoints are available.
+func SqliteStorage(capacity int64) StorageFactory {
+	return func(dir string) (storage.ClientImplCloser, error) {
+		return openStorageCache(filepath.Join(dir, "storage-cache.db"), capacity)
+	}
+}
+
+// Stores pieces in a squirrel cache the embedder already has open, and might share with other uses.
+// The cache isn't closed with the handler.
+func SquirrelStorage(cache *squirrel.Cache) StorageFactory {
+	return func(string) (storage.ClientImplCloser, error) {
+		return squirrelStorage{sqliteStorage.NewWrappingClient(cache)}, nil
+	}
+}
+
+type squirrelStorage struct {
+	storage.ClientImpl
+}
+
+func (squirrelStorage) Close() error {
+	return nil
+}
+
+// Creates storage in dir with the factory, or defaultFactory if it's nil.
+func newRoleStorage(factory, defaultFactory StorageFactory, dir string) (storage.ClientImplCloser, error) {
+	if factory == nil {
+		factory = defaultFactory
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return factory(dir)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/squirrel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestStorageFactories(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	query := url.Values{"link": {*output.Link}}.Encode()
+
+	var opts squirrel.NewCacheOpts
+	opts.Path = filepath.Join(t.TempDir(), "squirrel.db")
+	cache, err := squirrel.NewCache(opts)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	for _, tc := range []struct {
+		name    string
+		factory StorageFactory
+		// Whether the cache endpoints are available.
+		cache bool
+	}{
+		{"File", FileStorage(), false},
+		{"FileByInfoHash", FileByInfoHashStorage(), false},
+		{"MMap", MMapStorage(), false},
+		{"Sqlite", SqliteStorage(1 << 20), true},
+		{"Squirrel", SquirrelStorage(cache), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+				input.ViewStorage = tc.factory
+				input.LibraryStorage = tc.factory
+			})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/view?"+query, nil))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, "file content", w.Body.String())
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cache", nil))
+			if tc.cache {
+				assert.Equal(t, http.StatusOK, w.Code)
+			} else {
+				assert.Equal(t, http.StatusNotImplemented, w.Code)
+			}
+		})
+	}
+}
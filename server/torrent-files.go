@@ -0,0 +1,115 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/errors"
+)
+
+type torrentFileList struct {
+	InfoHash string             `json:"infoHash"`
+	Name     string             `json:"name"`
+	Files    []torrentFileEntry `json:"files"`
+}
+
+type torrentFileEntry struct {
+	Index int `json:"index"`
+	// Slash-separated, and excludes the torrent name for multi-file torrents. This is what the
+	// "path" query value for views and downloads takes.
+	Path           string `json:"path"`
+	Length         int64  `json:"length"`
+	MimeType       string `json:"mimeType"`
+	BytesCompleted int64  `json:"bytesCompleted"`
+	// The request's link, selecting this file.
+	Link string `json:"replicaLink"`
+	// Relative to the files endpoint.
+	ViewUrl     string `json:"viewUrl"`
+	DownloadUrl string `json:"downloadUrl"`
+}
+
+// Returns m with the file at index selected, and named for it.
+func fileLink(m metainfo.Magnet, index int, filePath string) string {
+	m.DisplayName = filePath
+	params := url.Values{}
+	for k, v := range m.Params {
+		params[k] = v
+	}
+	params.Set("so", strconv.Itoa(index))
+	m.Params = params
+	return m.String()
+}
+
+// Finds the file a view or download is for: the "path" query value, or otherwise the link's "so"
+// parameter.
+func selectTorrentFile(t *torrent.Torrent, m metainfo.Magnet, query url.Values) (*torrent.File, error) {
+	files := t.Files()
+	if query.Has("path") {
+		filePath := query.Get("path")
+		for _, f := range files {
+			if f.DisplayPath() == filePath {
+				return f, nil
+			}
+		}
+		return nil, handlerError{http.StatusNotFound, errors.New("no file with path %q", filePath)}
+	}
+	selectOnly, err := strconv.ParseUint(m.Params.Get("so"), 10, 0)
+	// Assume that it should be present, as it'll be added going forward where possible. When it's
+	// missing, zero is a perfectly adequate default for now.
+	if err != nil {
+		log.Errorf("error parsing so field: %v", err)
+	}
+	if selectOnly >= uint64(len(files)) {
+		return nil, handlerError{
+			http.StatusNotFound,
+			errors.New("file index %v out of range for %v files", selectOnly, len(files)),
+		}
+	}
+	return files[selectOnly], nil
+}
+
+// Lists the files in a torrent, with links to view or download each of them.
+func (me *HttpHandler) handleFiles(rw InstrumentedResponseWriter, r *http.Request) error {
+	link := r.URL.Query().Get("link")
+	m, err := metainfo.ParseMagnetUri(link)
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+	}
+	rw.Set("info_hash", m.InfoHash)
+
+	t, _, release := me.confluence.GetTorrent(m.InfoHash)
+	defer release()
+	gc := me.GlobalConfig()
+	addReplicaPeers(gc, t)
+	err = me.waitForTorrentInfo(r.Context(), t, metainfoUrls(m, gc))
+	if err != nil {
+		return err
+	}
+
+	list := torrentFileList{
+		InfoHash: t.InfoHash().HexString(),
+		Name:     t.Info().BestName(),
+		Files:    make([]torrentFileEntry, 0, len(t.Files())),
+	}
+	for i, f := range t.Files() {
+		filePath := f.DisplayPath()
+		fileLink := fileLink(m, i, filePath)
+		query := url.Values{"link": {fileLink}}.Encode()
+		list.Files = append(list.Files, torrentFileEntry{
+			Index:          i,
+			Path:           filePath,
+			Length:         f.Length(),
+			MimeType:       mime.TypeByExtension(path.Ext(filePath)),
+			BytesCompleted: f.BytesCompleted(),
+			Link:           fileLink,
+			ViewUrl:        "view?" + query,
+			DownloadUrl:    "download?" + query,
+		})
+	}
+	return encodeJsonResponse(rw, list)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestTorrentFiles(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+target, nil))
+		return w
+	}
+
+	output, err := srv.ServiceClient().UploadFiles("show", []service.MultiUploadFile{
+		{Path: []string{"show", "episode.mp4"}, Reader: strings.NewReader("episode content")},
+		{Path: []string{"show", "notes.txt"}, Reader: strings.NewReader("notes content")},
+	}, service.UploadOptions{})
+	require.NoError(t, err)
+	link := *output.Link
+
+	w := get("files?" + url.Values{"link": {link}}.Encode())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list torrentFileList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Files, 2)
+	for i, content := range []string{"episode content", "notes content"} {
+		f := list.Files[i]
+		assert.Equal(t, i, f.Index)
+		assert.EqualValues(t, len(content), f.Length)
+		w := get(f.ViewUrl)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, content, w.Body.String())
+		assert.Equal(t, http.StatusOK, get(f.DownloadUrl).Code)
+	}
+	assert.True(t, strings.HasSuffix(list.Files[0].Path, "episode.mp4"), list.Files[0].Path)
+	assert.Equal(t, "video/mp4", list.Files[0].MimeType)
+	// Viewing the files completed them.
+	require.NoError(t, json.Unmarshal(get("files?"+url.Values{"link": {link}}.Encode()).Body.Bytes(), &list))
+	for _, f := range list.Files {
+		assert.Equal(t, f.Length, f.BytesCompleted)
+	}
+
+	w = get("view?" + url.Values{"link": {link}, "path": {list.Files[1].Path}}.Encode())
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "notes content", w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "notes.txt")
+
+	w = get("view?" + url.Values{"link": {link}, "path": {"missing.txt"}}.Encode())
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	m, err := metainfo.ParseMagnetUri(link)
+	require.NoError(t, err)
+	w = get("view?" + url.Values{"link": {fileLink(m, 2, "")}}.Encode())
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/errors"
+)
+
+// How long views and downloads wait for a torrent's info if NewHttpHandlerInput doesn't say.
+const defaultMetadataTimeout = time.Minute
+
+type metainfoSourceFailure struct {
+	Url   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// Returned when a torrent's info isn't obtained before the metadata timeout.
+type metadataTimeoutError struct {
+	InfoHash metainfo.Hash
+	Timeout  time.Duration
+	// The metainfo sources that were tried, and why they failed.
+	Sources []metainfoSourceFailure
+	// Peers connected when we gave up. Any of them could have provided the info.
+	Peers int
+}
+
+func (me *metadataTimeoutError) Error() string {
+	return fmt.Sprintf(
+		"timed out after %v waiting for info for %v (%v metainfo sources failed, %v peers connected)",
+		me.Timeout, me.InfoHash, len(me.Sources), me.Peers)
+}
+
+func (me *HttpHandler) metadataTimeout() time.Duration {
+	if me.MetadataTimeout > 0 {
+		return me.MetadataTimeout
+	}
+	return defaultMetadataTimeout
+}
+
+// Gets the info for t from the metainfo sources in parallel, while the torrent client tries to get it
+// from peers using ut_metadata. The sources still going are stopped once the info arrives. Returns
+// ctx's error if it's done first.
+func (me *HttpHandler) waitForTorrentInfo(ctx context.Context, t *torrent.Torrent, sources []string) error {
+	select {
+	case <-t.GotInfo():
+		return nil
+	default:
+	}
+	timeout := me.metadataTimeout()
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		source string
+		err    error
+	}
+	// Buffered so fetches don't block once we stop listening.
+	results := make(chan result, len(sources))
+	for _, source := range sources {
+		go func() {
+			results <- result{source, me.fetchTorrentInfo(timeoutCtx, t, source)}
+		}()
+	}
+	failures := make([]metainfoSourceFailure, 0, len(sources))
+	addFailure := func(res result) {
+		log.Debugf("getting info for %v from %q: %v", t.InfoHash(), res.source, res.err)
+		failures = append(failures, metainfoSourceFailure{res.source, res.err.Error()})
+	}
+	for pending := len(sources); ; {
+		// Nil once every source is done, leaving the peers.
+		resultsOrNil := results
+		if pending == 0 {
+			resultsOrNil = nil
+		}
+		select {
+		case <-t.GotInfo():
+			return nil
+		case res := <-resultsOrNil:
+			pending--
+			if res.err != nil {
+				addFailure(res)
+			}
+		case <-timeoutCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The sources still going stop with the timeout, and are reported with it.
+			for ; pending > 0; pending-- {
+				if res := <-results; res.err != nil {
+					addFailure(res)
+				}
+			}
+			return &metadataTimeoutError{
+				InfoHash: t.InfoHash(),
+				Timeout:  timeout,
+				Sources:  failures,
+				Peers:    len(t.PeerConns()),
+			}
+		}
+	}
+}
+
+func (me *HttpHandler) fetchTorrentInfo(ctx context.Context, t *torrent.Torrent, source string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := me.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected response status %q", resp.Status)
+	}
+	mi, err := metainfo.Load(resp.Body)
+	if err != nil {
+		return errors.New("loading metainfo: %v", err)
+	}
+	if mi.HashInfoBytes() != t.InfoHash() {
+		return errors.New("metainfo is for %v", mi.HashInfoBytes())
+	}
+	return t.SetInfoBytes(mi.InfoBytes)
+}
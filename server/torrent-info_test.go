@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/types/infohash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestViewMetadataTimeout(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		input.MetadataTimeout = 500 * time.Millisecond
+	})
+	view := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/view?"+url.Values{"link": {link}}.Encode(), nil))
+		return w
+	}
+
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	w := view(*output.Link)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "file content", string(body))
+
+	missing := metainfo.Magnet{InfoHash: infohash.HashBytes([]byte("missing"))}
+	started := time.Now()
+	w = view(missing.String())
+	assert.Less(t, time.Since(started), 5*time.Second)
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+	var resp struct {
+		ErrorCode       string
+		MetainfoSources []metainfoSourceFailure
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "metadata_timeout", resp.ErrorCode)
+	require.Len(t, resp.MetainfoSources, 1)
+	assert.Equal(t, srv.MetainfoUrl(service.Prefix(missing.InfoHash.HexString())), resp.MetainfoSources[0].Url)
+	assert.Contains(t, resp.MetainfoSources[0].Error, "404")
+}
+
+// A source that doesn't respond doesn't hold up the others, and is stopped once the info arrives.
+func TestWaitForTorrentInfoSlowSource(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		input.MetadataTimeout = time.Hour
+	})
+	output, err := srv.ServiceClient().Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{})
+	require.NoError(t, err)
+	slowCancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(slowCancelled)
+	}))
+	defer slow.Close()
+	torr, _ := handler.torrentClient.AddTorrentInfoHash(output.MetaInfo.HashInfoBytes())
+	defer torr.Drop()
+
+	sources := []string{slow.URL, srv.MetainfoUrl(output.Upload.Prefix)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, handler.waitForTorrentInfo(ctx, torr, sources))
+	select {
+	case <-slowCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow source wasn't cancelled")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/errors"
+)
+
+type torrentStatus struct {
+	InfoHash string `json:"infoHash"`
+	Name     string `json:"name,omitempty"`
+	// Until this is set, the torrent is still finding its metadata and the remaining fields about
+	// its data are zero.
+	InfoKnown      bool                   `json:"infoKnown"`
+	BytesCompleted int64                  `json:"bytesCompleted"`
+	Length         int64                  `json:"length"`
+	NumPieces      int                    `json:"numPieces"`
+	PiecesComplete int                    `json:"piecesComplete"`
+	Pieces         []torrentPieceRun      `json:"pieces"`
+	Peers          torrentStatusPeers     `json:"peers"`
+	Webseeds       []torrentWebseedStatus `json:"webseeds"`
+}
+
+// Consecutive pieces in the same state.
+type torrentPieceRun struct {
+	Length   int  `json:"length"`
+	Complete bool `json:"complete"`
+	Partial  bool `json:"partial"`
+	Checking bool `json:"checking"`
+}
+
+// Connected peers by how they were found.
+type torrentStatusPeers struct {
+	Tracker  int `json:"tracker"`
+	Dht      int `json:"dht"`
+	Static   int `json:"static"`
+	Pex      int `json:"pex"`
+	Incoming int `json:"incoming"`
+	Other    int `json:"other"`
+	Webseed  int `json:"webseed"`
+}
+
+type torrentWebseedStatus struct {
+	Host string `json:"host"`
+	// Useful bytes per second while waiting on requests to the webseed.
+	DownloadRate float64 `json:"downloadRate"`
+}
+
+func getTorrentStatus(t *torrent.Torrent) (ret torrentStatus) {
+	ret.InfoHash = t.InfoHash().HexString()
+	ret.Name = t.Name()
+	ret.InfoKnown = t.Info() != nil
+	if ret.InfoKnown {
+		ret.BytesCompleted = t.BytesCompleted()
+		ret.Length = t.Length()
+		ret.NumPieces = t.NumPieces()
+		ret.PiecesComplete = t.Stats().PiecesComplete
+		for _, run := range t.PieceStateRuns() {
+			ret.Pieces = append(ret.Pieces, torrentPieceRun{
+				Length:   run.Length,
+				Complete: run.Complete,
+				Partial:  run.Partial,
+				Checking: run.Checking,
+			})
+		}
+	}
+	for _, pc := range t.PeerConns() {
+		switch pc.Discovery {
+		case torrent.PeerSourceTracker:
+			ret.Peers.Tracker++
+		case torrent.PeerSourceDhtGetPeers, torrent.PeerSourceDhtAnnouncePeer:
+			ret.Peers.Dht++
+		case torrent.PeerSourceDirect:
+			// This is how ApplyReplicaOptions adds static peers.
+			ret.Peers.Static++
+		case torrent.PeerSourcePex:
+			ret.Peers.Pex++
+		case torrent.PeerSourceIncoming:
+			ret.Peers.Incoming++
+		default:
+			ret.Peers.Other++
+		}
+	}
+	for _, ws := range t.WebseedPeerConns() {
+		ret.Peers.Webseed++
+		ret.Webseeds = append(ret.Webseeds, torrentWebseedStatus{
+			Host:         ws.RemoteAddr.String(),
+			DownloadRate: ws.DownloadRate(),
+		})
+	}
+	return
+}
+
+// Reports on a torrent already in the client, such as one being viewed or downloaded.
+func (me *HttpHandler) handleTorrentStatus(rw InstrumentedResponseWriter, r *http.Request) error {
+	m, err := metainfo.ParseMagnetUri(r.URL.Query().Get("link"))
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing magnet link: %v", err)}
+	}
+	rw.Set("info_hash", m.InfoHash)
+	t, ok := me.torrentClient.Torrent(m.InfoHash)
+	if !ok {
+		return handlerError{http.StatusNotFound, errors.New("torrent %v is not active", m.InfoHash)}
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	return encodeJsonResponse(rw, getTorrentStatus(t))
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestTorrentStatus(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/upload?name=file.txt", strings.NewReader("file content"))
+	require.NoError(t, handler.handleUpload(&NoopInstrumentedResponseWriter{w}, r))
+	var oi objectInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &oi))
+
+	status := func() (torrentStatus, int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/torrent_status?"+url.Values{"link": {oi.Link}}.Encode(), nil)
+		handler.ServeHTTP(w, r)
+		var ts torrentStatus
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ts))
+		}
+		return ts, w.Code
+	}
+	_, code := status()
+	assert.Equal(t, http.StatusNotFound, code)
+
+	m, err := metainfo.ParseMagnetUri(oi.Link)
+	require.NoError(t, err)
+	tor, _, release := handler.confluence.GetTorrent(m.InfoHash)
+	defer release()
+	ApplyReplicaOptions(handler.GlobalConfig(), tor)
+	<-tor.GotInfo()
+	tor.DownloadAll()
+	require.Eventually(t, func() bool {
+		ts, _ := status()
+		return ts.InfoKnown && ts.PiecesComplete == ts.NumPieces
+	}, 10*time.Second, 10*time.Millisecond)
+
+	ts, code := status()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, m.InfoHash.HexString(), ts.InfoHash)
+	assert.EqualValues(t, len("file content"), ts.Length)
+	assert.Equal(t, ts.Length, ts.BytesCompleted)
+	require.Len(t, ts.Pieces, 1)
+	assert.True(t, ts.Pieces[0].Complete)
+	assert.Equal(t, 1, ts.Peers.Webseed)
+	require.Len(t, ts.Webseeds, 1)
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), ts.Webseeds[0].Host)
+}
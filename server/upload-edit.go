@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/replica/service"
+)
+
+// Returns the zero value if nothing was stored for the upload. stored is false then, and the
+// upload's options might only be known to the service, as for uploads made before they were kept.
+func (me *HttpHandler) loadUploadOptions(prefix service.Prefix) (uo service.UploadOptions, stored bool, err error) {
+	b, err := os.ReadFile(me.uploadOptionsPath(prefix))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &uo)
+	stored = err == nil
+	return
+}
+
+// Uploads without any options don't get a file.
+func (me *HttpHandler) storeUploadOptions(prefix service.Prefix, uo service.UploadOptions) error {
+	path := me.uploadOptionsPath(prefix)
+	if uo.Encode() == "" {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	b, err := json.Marshal(uo)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Changes the options, like the title and description, of one of our uploads. Options not in the
+// request keep the values stored locally. Uploads without stored options, like those made before
+// options were kept, have to be given all of them, since the service replaces them all.
+func (me *HttpHandler) handleUploadEdit(rw InstrumentedResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+	default:
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	if err := r.ParseForm(); err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing form: %v", err)}
+	}
+	_, upload, err := uploadFromLink(r.Form.Get("link"))
+	if err != nil {
+		return err
+	}
+	keys := service.UploadOptionKeys(r.Form)
+	if len(keys) == 0 {
+		return handlerError{http.StatusBadRequest, errors.New("no upload options given")}
+	}
+	auth, err := me.UploadTokenStore.Get(upload.Prefix)
+	if isNotExist(err) {
+		return handlerError{http.StatusGone, errors.New("no upload token found")}
+	}
+	if err != nil {
+		return errors.New("reading upload token: %v", err)
+	}
+	uo, stored, err := me.loadUploadOptions(upload.Prefix)
+	if err != nil {
+		log.Errorf("loading upload options for %q: %v", upload.Prefix, err)
+	}
+	if !stored && len(keys) != len(service.UploadOptionFormKeys) {
+		return handlerError{
+			http.StatusConflict,
+			errors.New("upload options aren't stored locally, so all of %q must be given", service.UploadOptionFormKeys),
+		}
+	}
+	uo.SetFromValues(r.Form)
+	if err := uo.Validate(); err != nil {
+		return handlerError{http.StatusBadRequest, err}
+	}
+	err = me.ReplicaServiceClient.UpdateUpload(upload.Prefix, auth, uo)
+	if err != nil {
+		return errors.New("updating upload: %v", err)
+	}
+	err = me.storeUploadOptions(upload.Prefix, uo)
+	if err != nil {
+		return errors.New("storing upload options: %v", err)
+	}
+	return encodeJsonResponse(rw, uo)
+}
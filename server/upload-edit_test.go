@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestUploadEdit(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := HttpHandler{uploadsDir: t.TempDir()}
+	var err error
+	handler.UploadTokenStore, err = NewUploadTokenStore(handler.uploadsDir, []byte("secret"))
+	require.NoError(t, err)
+	handler.ReplicaServiceClient = srv.ServiceClient()
+	original := service.UploadOptions{Title: "old", Description: "kept"}
+	output, err := handler.ReplicaServiceClient.Upload(strings.NewReader("content"), "file", original)
+	require.NoError(t, err)
+	prefix := output.Upload.Prefix
+	link := *output.Link
+	serviceOptions := func() service.UploadOptions {
+		obj, ok := srv.Object(prefix)
+		require.True(t, ok)
+		return obj.Options
+	}
+	edit := func(params url.Values) (*httptest.ResponseRecorder, error) {
+		params.Set("link", link)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/upload/edit?"+params.Encode(), nil)
+		return w, handler.handleUploadEdit(&NoopInstrumentedResponseWriter{w}, r)
+	}
+
+	_, err = edit(url.Values{"title": {"title"}})
+	var he handlerError
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusGone, he.statusCode)
+
+	require.NoError(t, handler.UploadTokenStore.Put(prefix, *output.AuthToken))
+	require.NoError(t, handler.storeUploadOptions(prefix, original))
+	w, err := edit(url.Values{"title": {"new"}})
+	require.NoError(t, err)
+	assert.Equal(t, service.UploadOptions{Title: "new", Description: "kept"}, serviceOptions())
+	var uo service.UploadOptions
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &uo))
+	assert.Equal(t, service.UploadOptions{Title: "new", Description: "kept"}, uo)
+	uo, stored, err := handler.loadUploadOptions(prefix)
+	require.NoError(t, err)
+	assert.True(t, stored)
+	assert.Equal(t, "new", uo.Title)
+
+	r := httptest.NewRequest(http.MethodGet, "/upload/edit?"+url.Values{"link": {link}, "title": {"get"}}.Encode(), nil)
+	err = handler.handleUploadEdit(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, r)
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusMethodNotAllowed, he.statusCode)
+	assert.Equal(t, "new", serviceOptions().Title)
+
+	_, err = edit(url.Values{})
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+	_, err = edit(url.Values{"license": {"wtfpl"}})
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+	w, err = edit(url.Values{"tag": {"a", "b"}, "license": {"cc0"}})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &uo))
+	assert.Equal(t, []string{"a", "b"}, uo.Tags)
+	assert.Equal(t, "cc0", uo.License)
+	assert.Equal(t, []string{"a", "b"}, serviceOptions().Tags)
+
+	// Clearing everything removes the stored options.
+	_, err = edit(url.Values{"title": {""}, "description": {""}, "tag": {""}, "license": {""}})
+	require.NoError(t, err)
+	_, err = os.Stat(handler.uploadOptionsPath(prefix))
+	assert.True(t, os.IsNotExist(err))
+	assert.Zero(t, serviceOptions())
+}
+
+// Uploads without stored options, like those made before options were kept, can only have all their
+// options replaced, since the others aren't known.
+func TestUploadEditWithoutLocalOptions(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := HttpHandler{uploadsDir: t.TempDir()}
+	var err error
+	handler.UploadTokenStore, err = NewUploadTokenStore(handler.uploadsDir, []byte("secret"))
+	require.NoError(t, err)
+	handler.ReplicaServiceClient = srv.ServiceClient()
+	original := service.UploadOptions{
+		Title:       "old",
+		Description: "description",
+		Tags:        []string{"tag"},
+		Language:    "en",
+		License:     "cc0",
+	}
+	output, err := handler.ReplicaServiceClient.Upload(strings.NewReader("content"), "file", original)
+	require.NoError(t, err)
+	prefix := output.Upload.Prefix
+	require.NoError(t, handler.UploadTokenStore.Put(prefix, *output.AuthToken))
+	_, err = os.Stat(handler.uploadOptionsPath(prefix))
+	require.True(t, os.IsNotExist(err))
+	edit := func(params url.Values) error {
+		params.Set("link", *output.Link)
+		r := httptest.NewRequest(http.MethodPost, "/upload/edit?"+params.Encode(), nil)
+		return handler.handleUploadEdit(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, r)
+	}
+	serviceOptions := func() service.UploadOptions {
+		obj, ok := srv.Object(prefix)
+		require.True(t, ok)
+		return obj.Options
+	}
+
+	var he handlerError
+	require.ErrorAs(t, edit(url.Values{"title": {"new"}}), &he)
+	assert.Equal(t, http.StatusConflict, he.statusCode)
+	assert.Equal(t, original, serviceOptions())
+
+	require.NoError(t, edit(url.Values{
+		"title":       {"new"},
+		"description": {"description"},
+		"tag":         {""},
+		"language":    {"en"},
+		"license":     {"cc0"},
+		"category":    {"books"},
+	}))
+	expected := original
+	expected.Title = "new"
+	expected.Tags = nil
+	expected.ContentCategories = []string{"books"}
+	assert.Equal(t, expected, serviceOptions())
+
+	// Now they're stored, only what's changing needs to be given.
+	require.NoError(t, edit(url.Values{"description": {"changed"}}))
+	expected.Description = "changed"
+	assert.Equal(t, expected, serviceOptions())
+}
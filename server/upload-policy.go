@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/replica/service"
+)
+
+// UploadPolicy restricts what can be uploaded. The zero value allows anything.
+type UploadPolicy struct {
+	// The most bytes an upload can have across all its files. Zero is no limit.
+	MaxSize int64
+	// If not empty, each file's MIME type must match one of these. The type is sniffed from the
+	// content with http.DetectContentType, so only types it knows are distinguished. Patterns are a
+	// type like "video/mp4", or a wildcard like "video/*".
+	AllowedMimeTypes []string
+	// Files with MIME types matching these are refused, even if they're allowed.
+	BlockedMimeTypes []string
+	// File name extensions that are refused, like ".exe". Matching ignores case.
+	BlockedExtensions []string
+}
+
+// Implemented by ReplicaOptions that restrict uploads.
+type uploadPolicyGetter interface {
+	GetUploadPolicy() UploadPolicy
+}
+
+// Room for multipart headers and boundaries when comparing a request's length to MaxSize.
+const uploadPolicyRequestOverhead = 1 << 20
+
+// The content sniffed to detect MIME types. This is all http.DetectContentType looks at.
+const uploadSniffLength = 512
+
+// The policy from NewHttpHandlerInput, or otherwise the replica options.
+func (me *HttpHandler) uploadPolicy() UploadPolicy {
+	if me.UploadPolicy != nil {
+		return *me.UploadPolicy
+	}
+	if me.GlobalConfig != nil {
+		if getter, ok := me.GlobalConfig().(uploadPolicyGetter); ok {
+			return getter.GetUploadPolicy()
+		}
+	}
+	return UploadPolicy{}
+}
+
+// Parses an upload request as uploadRequest does, and enforces the upload policy on everything that
+// can be known before the content is read. Reading more than the policy allows from the sources
+// fails, and is recorded in the returned limit.
+func (me *HttpHandler) policedUploadRequest(r *http.Request) (
+	fileName string,
+	sources []uploadSource,
+	uploadOptions service.UploadOptions,
+	sizeLimit *uploadSizeLimit,
+	err error,
+) {
+	policy := me.uploadPolicy()
+	if policy.MaxSize > 0 && r.ContentLength > policy.MaxSize+uploadPolicyRequestOverhead {
+		err = policy.tooLargeError()
+		return
+	}
+	fileName, sources, uploadOptions, err = uploadRequest(r)
+	if err != nil {
+		return
+	}
+	sizeLimit, err = policy.enforce(sources)
+	if err != nil {
+		closeUploadSources(sources)
+		sources = nil
+	}
+	return
+}
+
+func (me UploadPolicy) tooLargeError() error {
+	return handlerError{
+		http.StatusRequestEntityTooLarge,
+		errors.New("upload is larger than the limit of %v bytes", me.MaxSize),
+	}
+}
+
+// Checks the file names, known sizes and sniffed types of the sources. The sources are wrapped to
+// fail if they're read beyond MaxSize.
+func (me UploadPolicy) enforce(sources []uploadSource) (*uploadSizeLimit, error) {
+	for _, s := range sources {
+		ext := strings.ToLower(path.Ext(s.path[len(s.path)-1]))
+		if ext != "" && slices.ContainsFunc(me.BlockedExtensions, func(blocked string) bool {
+			return "."+strings.TrimPrefix(strings.ToLower(blocked), ".") == ext
+		}) {
+			return nil, handlerError{
+				http.StatusUnsupportedMediaType,
+				errors.New("files with extension %q can't be uploaded", ext),
+			}
+		}
+	}
+	if me.MaxSize > 0 {
+		if size := uploadSourcesSize(sources); size > me.MaxSize {
+			return nil, me.tooLargeError()
+		}
+	}
+	if len(me.AllowedMimeTypes) != 0 || len(me.BlockedMimeTypes) != 0 {
+		for i := range sources {
+			mimeType, err := sniffUploadSource(&sources[i])
+			if err != nil {
+				return nil, errors.New("sniffing %q: %v", sources[i].path, err)
+			}
+			if !me.mimeTypeAllowed(mimeType) {
+				return nil, handlerError{
+					http.StatusUnsupportedMediaType,
+					errors.New("files of type %q can't be uploaded", mimeType),
+				}
+			}
+		}
+	}
+	if me.MaxSize <= 0 {
+		return nil, nil
+	}
+	l := &uploadSizeLimit{policy: me}
+	l.remaining.Store(me.MaxSize)
+	for i, s := range sources {
+		sources[i].ReadCloser = readCloser{&uploadSizeLimitedReader{s.ReadCloser, l}, s}
+	}
+	return l, nil
+}
+
+func (me UploadPolicy) mimeTypeAllowed(mimeType string) bool {
+	if mimeTypeMatches(mimeType, me.BlockedMimeTypes) {
+		return false
+	}
+	return len(me.AllowedMimeTypes) == 0 || mimeTypeMatches(mimeType, me.AllowedMimeTypes)
+}
+
+func mimeTypeMatches(mimeType string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == mimeType || p == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detects the MIME type of the source without consuming any of it.
+func sniffUploadSource(s *uploadSource) (string, error) {
+	br := bufio.NewReaderSize(s.ReadCloser, uploadSniffLength)
+	head, err := br.Peek(uploadSniffLength)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	s.ReadCloser = readCloser{br, s.ReadCloser}
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	return mimeType, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Tracks the bytes read from all the sources of an upload.
+type uploadSizeLimit struct {
+	policy    UploadPolicy
+	remaining atomic.Int64
+	exceeded  atomic.Bool
+}
+
+// Whether reading failed because the upload is too large. The limit can be nil.
+func (me *uploadSizeLimit) Exceeded() bool {
+	return me != nil && me.exceeded.Load()
+}
+
+func (me *uploadSizeLimit) err() error {
+	return me.policy.tooLargeError()
+}
+
+type uploadSizeLimitedReader struct {
+	r io.Reader
+	l *uploadSizeLimit
+}
+
+// Reads at most one byte past the limit, to detect it, and doesn't return that byte.
+func (me *uploadSizeLimitedReader) Read(b []byte) (n int, err error) {
+	remaining := me.l.remaining.Load()
+	if remaining < 0 {
+		return 0, me.l.err()
+	}
+	if int64(len(b)) > remaining+1 {
+		b = b[:remaining+1]
+	}
+	n, err = me.r.Read(b)
+	if over := -me.l.remaining.Add(-int64(n)); over > 0 {
+		me.l.exceeded.Store(true)
+		return n - int(min(over, int64(n))), me.l.err()
+	}
+	return
+}
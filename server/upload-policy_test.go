@@ -0,0 +1,98 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+type uploadPolicyReplicaOptions struct {
+	testReplicaOptions
+	policy UploadPolicy
+}
+
+func (me uploadPolicyReplicaOptions) GetUploadPolicy() UploadPolicy {
+	return me.policy
+}
+
+func TestUploadPolicy(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := HttpHandler{metrics: newMetricsRegistry()}
+	handler.HttpClient = srv.Client()
+	handler.GlobalConfig = func() ReplicaOptions {
+		return uploadPolicyReplicaOptions{
+			testReplicaOptions: testReplicaOptions{webseedBaseUrls: []string{srv.WebseedBaseUrl()}},
+			policy: UploadPolicy{
+				MaxSize:           16,
+				AllowedMimeTypes:  []string{"text/*", "image/png"},
+				BlockedMimeTypes:  []string{"text/html"},
+				BlockedExtensions: []string{"EXE", ".bat"},
+			},
+		}
+	}
+	handler.ReplicaServiceClient = srv.ServiceClient()
+	upload := func(name string, body io.Reader) error {
+		r := httptest.NewRequest(http.MethodPost, "/upload?name="+name, body)
+		return handler.handleUpload(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, r)
+	}
+	requireStatus := func(t *testing.T, err error, statusCode int) {
+		var he handlerError
+		require.ErrorAs(t, err, &he)
+		assert.Equal(t, statusCode, he.statusCode)
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		requireStatus(t, upload("file.txt", strings.NewReader(strings.Repeat("a", 17))), http.StatusRequestEntityTooLarge)
+	})
+	t.Run("TooLargeUnknownSize", func(t *testing.T) {
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", 17)))
+		requireStatus(t, upload("file.txt", body), http.StatusRequestEntityTooLarge)
+		// The service client doesn't get any of the content past the limit to send.
+		handler.UploadPolicy = &UploadPolicy{MaxSize: 1 << 20}
+		defer func() { handler.UploadPolicy = nil }()
+		sent := handler.metrics.uploadBytesSent.Load()
+		body = io.MultiReader(strings.NewReader(strings.Repeat("a", 4<<20)))
+		requireStatus(t, upload("file.txt", body), http.StatusRequestEntityTooLarge)
+		assert.LessOrEqual(t, handler.metrics.uploadBytesSent.Load()-sent, int64(1<<20))
+	})
+	t.Run("BlockedExtension", func(t *testing.T) {
+		requireStatus(t, upload("setup.exe", strings.NewReader("text")), http.StatusUnsupportedMediaType)
+		requireStatus(t, upload("run.Bat", strings.NewReader("text")), http.StatusUnsupportedMediaType)
+	})
+	t.Run("BlockedMimeType", func(t *testing.T) {
+		requireStatus(t, upload("page.txt", strings.NewReader("<html></html>")), http.StatusUnsupportedMediaType)
+	})
+	t.Run("MimeTypeNotAllowed", func(t *testing.T) {
+		requireStatus(t, upload("file.txt", strings.NewReader("%PDF-1.4")), http.StatusUnsupportedMediaType)
+	})
+	assert.Empty(t, srv.Objects(), "nothing refused should reach the service")
+
+	t.Run("Allowed", func(t *testing.T) {
+		require.NoError(t, upload("file.txt", strings.NewReader("file content")))
+		require.NoError(t, upload("image", strings.NewReader("\x89PNG\r\n\x1a\n")))
+		assert.Len(t, srv.Objects(), 2)
+	})
+
+	t.Run("InputOverridesGlobalConfig", func(t *testing.T) {
+		handler.UploadPolicy = &UploadPolicy{}
+		defer func() { handler.UploadPolicy = nil }()
+		require.NoError(t, upload("setup.exe", strings.NewReader(strings.Repeat("a", 17))))
+	})
+}
+
+func TestMimeTypeMatches(t *testing.T) {
+	assert.True(t, mimeTypeMatches("video/mp4", []string{"video/*"}))
+	assert.True(t, mimeTypeMatches("video/mp4", []string{" Video/MP4"}))
+	assert.True(t, mimeTypeMatches("video/mp4", []string{"*/*"}))
+	assert.False(t, mimeTypeMatches("video/mp4", []string{"video"}))
+	assert.False(t, mimeTypeMatches("audio/mp4", []string{"video/*", "*"}))
+	assert.False(t, mimeTypeMatches("video/mp4", nil))
+}
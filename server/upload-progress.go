@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/chansync"
+	"github.com/getlantern/errors"
+	"github.com/google/uuid"
+)
+
+type uploadPhase string
+
+const (
+	uploadPhaseScrubbing             uploadPhase = "scrubbing"
+	uploadPhaseUploading             uploadPhase = "uploading"
+	uploadPhaseStoringMetainfo       uploadPhase = "storing_metainfo"
+	uploadPhaseAddingToTorrentClient uploadPhase = "adding_to_torrent_client"
+	uploadPhaseDone                  uploadPhase = "done"
+	uploadPhaseFailed                uploadPhase = "failed"
+)
+
+// How long finished uploads are kept around for late subscribers.
+const uploadProgressRetention = time.Minute
+
+// How long a subscriber waits for an upload it asked about to start.
+const uploadProgressStartWait = 10 * time.Second
+
+// How long a long-poll for upload progress waits for a change.
+const uploadProgressPollTimeout = 30 * time.Second
+
+// Limits how often events are sent to subscribers.
+const uploadProgressMinInterval = 250 * time.Millisecond
+
+var uploadIdRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// The state of an upload as reported to /upload/progress.
+type uploadProgressEvent struct {
+	Id    string      `json:"uploadId"`
+	Seq   int64       `json:"seq"`
+	Phase uploadPhase `json:"phase"`
+	// Bytes the Replica service has taken so far.
+	BytesSent int64 `json:"bytesSent"`
+	// The size of the upload before scrubbing, if the client told us.
+	TotalSize *int64      `json:"totalSize,omitempty"`
+	Result    *objectInfo `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func (me uploadProgressEvent) final() bool {
+	return me.Phase == uploadPhaseDone || me.Phase == uploadPhaseFailed
+}
+
+type uploadProgress struct {
+	mu      sync.Mutex
+	event   uploadProgressEvent
+	changed chansync.BroadcastCond
+	// Byte counts change far more often than subscribers want to hear about them. These limit it to
+	// once per uploadProgressMinInterval.
+	lastBytesBroadcast    time.Time
+	bytesBroadcastPending bool
+}
+
+func (me *uploadProgress) update(f func(*uploadProgressEvent)) {
+	me.mu.Lock()
+	f(&me.event)
+	me.event.Seq++
+	me.mu.Unlock()
+	me.changed.Broadcast()
+}
+
+func (me *uploadProgress) setPhase(phase uploadPhase) {
+	me.update(func(e *uploadProgressEvent) {
+		e.Phase = phase
+	})
+}
+
+// Counts bytes taken by the service. Subscribers are told at most once an interval, with anything
+// since included in a later broadcast.
+func (me *uploadProgress) addBytesSent(n int64) {
+	me.mu.Lock()
+	me.event.BytesSent += n
+	if me.bytesBroadcastPending {
+		me.mu.Unlock()
+		return
+	}
+	if wait := uploadProgressMinInterval - time.Since(me.lastBytesBroadcast); wait > 0 {
+		me.bytesBroadcastPending = true
+		me.mu.Unlock()
+		time.AfterFunc(wait, me.broadcastBytesSent)
+		return
+	}
+	me.mu.Unlock()
+	me.broadcastBytesSent()
+}
+
+func (me *uploadProgress) broadcastBytesSent() {
+	me.update(func(e *uploadProgressEvent) {
+		me.bytesBroadcastPending = false
+		me.lastBytesBroadcast = time.Now()
+	})
+}
+
+func (me *uploadProgress) finish(result *objectInfo, err error) {
+	me.update(func(e *uploadProgressEvent) {
+		if err != nil {
+			e.Phase = uploadPhaseFailed
+			e.Error = err.Error()
+		} else {
+			e.Phase = uploadPhaseDone
+			e.Result = result
+		}
+	})
+}
+
+// Returns the current state, and a channel that is closed when it changes.
+func (me *uploadProgress) snapshot() (uploadProgressEvent, <-chan struct{}) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.event, me.changed.Signaled()
+}
+
+type uploadProgressTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+	added   chansync.BroadcastCond
+}
+
+// Registers a new upload. An empty id is replaced with a generated one.
+func (me *uploadProgressTracker) start(id string, totalSize int64) (*uploadProgress, error) {
+	if id == "" {
+		id = uuid.New().String()
+	} else if !uploadIdRegexp.MatchString(id) {
+		return nil, handlerError{http.StatusBadRequest, errors.New("invalid upload id %q", id)}
+	}
+	up := &uploadProgress{event: uploadProgressEvent{
+		Id:    id,
+		Phase: uploadPhaseScrubbing,
+	}}
+	if totalSize >= 0 {
+		up.event.TotalSize = &totalSize
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if _, ok := me.uploads[id]; ok {
+		return nil, handlerError{http.StatusConflict, errors.New("upload id %q already in use", id)}
+	}
+	if me.uploads == nil {
+		me.uploads = make(map[string]*uploadProgress)
+	}
+	me.uploads[id] = up
+	me.added.Broadcast()
+	return up, nil
+}
+
+// Forgets the upload after subscribers have had a chance to see how it ended.
+func (me *uploadProgressTracker) retire(up *uploadProgress) {
+	time.AfterFunc(uploadProgressRetention, func() {
+		me.mu.Lock()
+		defer me.mu.Unlock()
+		if me.uploads[up.event.Id] == up {
+			delete(me.uploads, up.event.Id)
+		}
+	})
+}
+
+// Waits for the upload with the given id to be started, since subscribers can race the upload
+// request.
+func (me *uploadProgressTracker) wait(ctx context.Context, id string) (*uploadProgress, error) {
+	ctx, cancel := context.WithTimeout(ctx, uploadProgressStartWait)
+	defer cancel()
+	for {
+		me.mu.Lock()
+		up, ok := me.uploads[id]
+		added := me.added.Signaled()
+		me.mu.Unlock()
+		if ok {
+			return up, nil
+		}
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Reports progress for the upload with the "uploadId" given to /upload. Clients accepting
+// text/event-stream get server-sent events until the upload finishes. Otherwise this long-polls,
+// returning the state once its seq is greater than the "since" parameter. Both end early with what
+// they have when the handler is shutting down, so they don't hold it up.
+func (me *HttpHandler) handleUploadProgress(rw InstrumentedResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	waitCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-me.shuttingDown.Done():
+			cancel()
+		case <-waitCtx.Done():
+		}
+	}()
+	up, err := me.uploadProgress.wait(waitCtx, id)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		if me.shuttingDown.IsSet() {
+			return handlerError{http.StatusServiceUnavailable, errors.New("shutting down")}
+		}
+		return handlerError{http.StatusNotFound, errors.New("no upload with id %q", id)}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") && canFlush(rw) {
+		return me.streamUploadProgress(rw, r, up)
+	}
+	var since int64
+	if s := query.Get("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return handlerError{http.StatusBadRequest, errors.New("parsing since: %v", err)}
+		}
+	}
+	timeout := time.After(uploadProgressPollTimeout)
+	for {
+		event, changed := up.snapshot()
+		if event.Seq > since || event.final() {
+			return encodeJsonResponse(rw, event)
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return encodeJsonResponse(rw, event)
+		case <-me.shuttingDown.Done():
+			return encodeJsonResponse(rw, event)
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// Whether http.ResponseController can flush rw.
+func canFlush(rw http.ResponseWriter) bool {
+	for {
+		switch w := rw.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			rw = w.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+func (me *HttpHandler) streamUploadProgress(rw http.ResponseWriter, r *http.Request, up *uploadProgress) error {
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(rw)
+	for {
+		event, changed := up.snapshot()
+		b, err := json.Marshal(event)
+		if err != nil {
+			return encoderWriterError{err}
+		}
+		_, err = fmt.Fprintf(rw, "data: %s\n\n", b)
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return encoderWriterError{err}
+		}
+		if event.final() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return nil
+		case <-me.shuttingDown.Done():
+			return nil
+		}
+		select {
+		case <-time.After(uploadProgressMinInterval):
+		case <-r.Context().Done():
+			return nil
+		case <-me.shuttingDown.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadProgressLongPoll(t *testing.T) {
+	var handler HttpHandler
+	up, err := handler.uploadProgress.start("abc", 100)
+	require.NoError(t, err)
+	_, err = handler.uploadProgress.start("abc", 100)
+	require.Error(t, err, "upload ids must be unique")
+
+	poll := func(since string) (event uploadProgressEvent) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/upload/progress?uploadId=abc&since="+since, nil)
+		require.NoError(t, handler.handleUploadProgress(&NoopInstrumentedResponseWriter{w}, r))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &event))
+		return
+	}
+	up.setPhase(uploadPhaseUploading)
+	up.addBytesSent(42)
+	event := poll("0")
+	assert.Equal(t, uploadPhaseUploading, event.Phase)
+	assert.EqualValues(t, 42, event.BytesSent)
+	assert.EqualValues(t, 100, *event.TotalSize)
+
+	go up.finish(&objectInfo{Link: "magnet:"}, nil)
+	event = poll(strconv.FormatInt(event.Seq, 10))
+	// The poll might return before the finish has been applied.
+	for !event.final() {
+		event = poll(strconv.FormatInt(event.Seq, 10))
+	}
+	assert.Equal(t, uploadPhaseDone, event.Phase)
+	assert.Equal(t, "magnet:", event.Result.Link)
+}
+
+func TestUploadProgressEventStream(t *testing.T) {
+	handler := HttpHandler{metrics: newMetricsRegistry()}
+	srv := httptest.NewServer(handler.wrapHandlerError("test", handler.handleUploadProgress))
+	defer srv.Close()
+	handler.InstrumentResponseWriter = func(w http.ResponseWriter, label string) InstrumentedResponseWriter {
+		return &NoopInstrumentedResponseWriter{w}
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"?uploadId=xyz", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	// The subscriber can arrive before the upload.
+	respChan := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		respChan <- resp
+	}()
+	up, err := handler.uploadProgress.start("xyz", -1)
+	require.NoError(t, err)
+	resp := <-respChan
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	up.setPhase(uploadPhaseUploading)
+	up.finish(nil, assert.AnError)
+
+	var last uploadProgressEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &last))
+	}
+	assert.Equal(t, uploadPhaseFailed, last.Phase)
+	assert.Equal(t, assert.AnError.Error(), last.Error)
+	assert.Nil(t, last.TotalSize)
+}
+
+// An embedder's writer that can't be flushed.
+type unflushableResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (unflushableResponseWriter) Set(key string, value interface{}) {}
+
+func (unflushableResponseWriter) Finish() {}
+
+func (unflushableResponseWriter) FailIf(err error) {}
+
+func TestUploadProgressEventStreamUnflushable(t *testing.T) {
+	var handler HttpHandler
+	up, err := handler.uploadProgress.start("abc", 100)
+	require.NoError(t, err)
+	up.setPhase(uploadPhaseUploading)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/upload/progress?uploadId=abc", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	require.NoError(t, handler.handleUploadProgress(unflushableResponseWriter{w}, r))
+	// Long-polls instead.
+	var event uploadProgressEvent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &event))
+	assert.Equal(t, uploadPhaseUploading, event.Phase)
+}
+
+func TestUploadProgressBytesSentThrottled(t *testing.T) {
+	var tracker uploadProgressTracker
+	up, err := tracker.start("", -1)
+	require.NoError(t, err)
+	up.addBytesSent(1)
+	first, changed := up.snapshot()
+	for range 1000 {
+		up.addBytesSent(1)
+	}
+	event, _ := up.snapshot()
+	assert.Equal(t, first.Seq, event.Seq, "subscribers shouldn't be woken for every write")
+	// The bytes since are broadcast later.
+	select {
+	case <-changed:
+	case <-time.After(10 * uploadProgressMinInterval):
+		t.Fatal("bytes sent weren't broadcast")
+	}
+	event, _ = up.snapshot()
+	assert.Equal(t, first.Seq+1, event.Seq)
+	assert.EqualValues(t, 1001, event.BytesSent)
+}
@@ -0,0 +1,586 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	stdErrors "errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	metascrubber "github.com/getlantern/meta-scrubber"
+	"github.com/google/uuid"
+
+	"github.com/getlantern/replica/service"
+)
+
+// Uploads sent to /uploads/queue are scrubbed into their own directory under the queue directory,
+// with their state alongside, and sent in the background one at a time. The queue survives
+// restarts. Finished uploads are stored the same as those from /upload, and leave the queue.
+
+type uploadQueueState string
+
+const (
+	uploadQueuePending    uploadQueueState = "pending"
+	uploadQueueInProgress uploadQueueState = "in_progress"
+	uploadQueueFailed     uploadQueueState = "failed"
+)
+
+// How many times a queued upload is tried by default before it's marked failed, if its failures
+// are worth retrying. With the retry delays, this is most of a day.
+const defaultMaxUploadQueueAttempts = 40
+
+func (me *HttpHandler) maxUploadQueueAttempts() int {
+	if me.MaxUploadQueueAttempts > 0 {
+		return me.MaxUploadQueueAttempts
+	}
+	return defaultMaxUploadQueueAttempts
+}
+
+// Doubled for each failed attempt to get how long to wait before trying a queued upload again. This
+// is a var for tests.
+var uploadQueueRetryDelay = 30 * time.Second
+
+const maxUploadQueueRetryDelay = 30 * time.Minute
+
+type queuedUpload struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// The path of each file in the upload. The scrubbed content of file i is staged in files/<i>.
+	Paths    [][]string            `json:"paths"`
+	Size     int64                 `json:"size"`
+	Options  service.UploadOptions `json:"options"`
+	State    uploadQueueState      `json:"state"`
+	Added    time.Time             `json:"added"`
+	Attempts int                   `json:"attempts"`
+	// When a pending upload that failed before is next tried.
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	// The link to the upload once it's done, which is just before it leaves the queue.
+	Link string `json:"link,omitempty"`
+	// Only reported while the upload is in progress.
+	BytesSent int64 `json:"bytesSent,omitempty"`
+}
+
+type uploadQueue struct {
+	dir string
+	mu  sync.Mutex
+	// Cancelled uploads are removed from here straight away, including the current one.
+	items map[string]*queuedUpload
+	// The upload being sent, its progress, and how to stop it.
+	current         *queuedUpload
+	currentProgress *uploadProgress
+	cancelCurrent   context.CancelFunc
+	wake            chan struct{}
+	// Attempts allowed for failures other than the service being unreachable.
+	maxAttempts int
+}
+
+// Loads the uploads left in dir. Any that were in progress are pending again.
+func openUploadQueue(dir string, maxAttempts int) (*uploadQueue, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &uploadQueue{
+		dir:         dir,
+		items:       make(map[string]*queuedUpload),
+		wake:        make(chan struct{}, 1),
+		maxAttempts: maxAttempts,
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		item, err := q.load(e.Name())
+		if err != nil {
+			log.Errorf("loading queued upload %q: %v", e.Name(), err)
+			continue
+		}
+		if item.State == uploadQueueInProgress {
+			item.State = uploadQueuePending
+			if err := q.persist(item); err != nil {
+				log.Errorf("persisting queued upload %q: %v", item.Id, err)
+			}
+		}
+		q.items[item.Id] = item
+	}
+	return q, nil
+}
+
+func (q *uploadQueue) itemDir(id string) string {
+	return filepath.Join(q.dir, id)
+}
+
+func (q *uploadQueue) statePath(id string) string {
+	return filepath.Join(q.itemDir(id), "upload.json")
+}
+
+func (q *uploadQueue) filePath(id string, index int) string {
+	return filepath.Join(q.itemDir(id), "files", strconv.Itoa(index))
+}
+
+func (q *uploadQueue) load(id string) (*queuedUpload, error) {
+	b, err := os.ReadFile(q.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var item queuedUpload
+	err = json.Unmarshal(b, &item)
+	if err != nil {
+		return nil, err
+	}
+	if item.Id != id {
+		return nil, errors.New("state is for upload %q", item.Id)
+	}
+	return &item, nil
+}
+
+func (q *uploadQueue) persist(item *queuedUpload) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	path := q.statePath(item.Id)
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Scrubs the sources into the item's directory.
+func (q *uploadQueue) stage(item *queuedUpload, sources []uploadSource) (err error) {
+	dir := q.itemDir(item.Id)
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	err = os.MkdirAll(filepath.Join(dir, "files"), 0o700)
+	if err != nil {
+		return
+	}
+	files := make([]*os.File, len(sources))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range sources {
+		files[i], err = os.OpenFile(q.filePath(item.Id, i), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return
+		}
+	}
+	item.Size = 0
+	for i, s := range sources {
+		var scrubbedReader io.Reader
+		scrubbedReader, err = metascrubber.GetScrubber(s)
+		if err != nil {
+			return errors.New("getting metascrubber: %v", err)
+		}
+		var n int64
+		n, err = io.Copy(files[i], scrubbedReader)
+		if err != nil {
+			return errors.New("copying %q: %v", s.path, err)
+		}
+		item.Size += n
+	}
+	return nil
+}
+
+func (q *uploadQueue) add(item *queuedUpload) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.persist(item)
+	if err != nil {
+		return err
+	}
+	q.items[item.Id] = item
+	q.signal()
+	return nil
+}
+
+func (q *uploadQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Copies of the queued uploads in the order they were added.
+func (q *uploadQueue) list() []queuedUpload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := make([]queuedUpload, 0, len(q.items))
+	for _, item := range q.items {
+		itemCopy := *item
+		if item == q.current {
+			event, _ := q.currentProgress.snapshot()
+			itemCopy.BytesSent = event.BytesSent
+		}
+		ret = append(ret, itemCopy)
+	}
+	slices.SortFunc(ret, func(a, b queuedUpload) int {
+		return a.Added.Compare(b.Added)
+	})
+	return ret
+}
+
+// Starts the next pending upload that's due. If there isn't one, returns how long until one is
+// due, or -1 if there's nothing to wait for.
+func (q *uploadQueue) startNext(now time.Time, cancel context.CancelFunc) (
+	item *queuedUpload, progress *uploadProgress, wait time.Duration,
+) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	wait = -1
+	for _, candidate := range q.items {
+		if candidate.State != uploadQueuePending {
+			continue
+		}
+		if candidate.NextAttempt != nil && candidate.NextAttempt.After(now) {
+			if until := candidate.NextAttempt.Sub(now); wait < 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+		if item == nil || candidate.Added.Before(item.Added) {
+			item = candidate
+		}
+	}
+	if item == nil {
+		return
+	}
+	item.State = uploadQueueInProgress
+	item.Attempts++
+	item.NextAttempt = nil
+	if err := q.persist(item); err != nil {
+		log.Errorf("persisting queued upload %q: %v", item.Id, err)
+	}
+	progress = &uploadProgress{event: uploadProgressEvent{Id: item.Id, Phase: uploadPhaseUploading}}
+	q.current = item
+	q.currentProgress = progress
+	q.cancelCurrent = cancel
+	return
+}
+
+// Records how the current upload went. If interrupted is set, the upload is left to be resumed
+// later.
+func (q *uploadQueue) finish(item *queuedUpload, err error, interrupted bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current = nil
+	q.currentProgress = nil
+	q.cancelCurrent = nil
+	_, queued := q.items[item.Id]
+	if err == nil || !queued {
+		delete(q.items, item.Id)
+		if err := os.RemoveAll(q.itemDir(item.Id)); err != nil {
+			log.Errorf("removing queued upload %q: %v", item.Id, err)
+		}
+		return
+	}
+	if interrupted {
+		item.State = uploadQueuePending
+		item.Attempts--
+	} else if uploadQueueErrorUnreachable(err) || uploadQueueErrorRetryable(err) && item.Attempts < q.maxAttempts {
+		item.State = uploadQueuePending
+		// The shift is bounded so the delay can't overflow.
+		next := time.Now().Add(min(uploadQueueRetryDelay<<min(item.Attempts-1, 16), maxUploadQueueRetryDelay))
+		item.NextAttempt = &next
+		item.Error = err.Error()
+	} else {
+		item.State = uploadQueueFailed
+		item.Error = err.Error()
+	}
+	if err := q.persist(item); err != nil {
+		log.Errorf("persisting queued upload %q: %v", item.Id, err)
+	}
+}
+
+// The id of the upload being sent, if there is one.
+func (q *uploadQueue) currentId() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == nil {
+		return ""
+	}
+	return q.current.Id
+}
+
+func uploadQueueErrorRetryable(err error) bool {
+	var serviceErr *service.Error
+	return stdErrors.As(err, &serviceErr) && serviceErr.Retryable
+}
+
+// Whether the service couldn't be reached at all, like when there's no connectivity. These uploads
+// are tried until it can be.
+func uploadQueueErrorUnreachable(err error) bool {
+	var serviceErr *service.Error
+	return stdErrors.As(err, &serviceErr) && serviceErr.StatusCode == 0 && serviceErr.Retryable
+}
+
+func (q *uploadQueue) item(id string) (*queuedUpload, error) {
+	item, ok := q.items[id]
+	if !ok {
+		return nil, handlerError{http.StatusNotFound, errors.New("no queued upload with id %q", id)}
+	}
+	return item, nil
+}
+
+// Removes the upload from the queue, stopping it if it's in progress.
+func (q *uploadQueue) cancel(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, err := q.item(id)
+	if err != nil {
+		return err
+	}
+	delete(q.items, id)
+	if item == q.current {
+		// The files are removed once the upload stops using them.
+		q.cancelCurrent()
+		return nil
+	}
+	return os.RemoveAll(q.itemDir(id))
+}
+
+// Makes a failed upload pending again, or a pending upload due now, with a fresh set of attempts.
+func (q *uploadQueue) retry(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, err := q.item(id)
+	if err != nil {
+		return err
+	}
+	if item.State == uploadQueueInProgress {
+		return handlerError{http.StatusConflict, errors.New("upload %q is in progress", id)}
+	}
+	item.State = uploadQueuePending
+	item.Attempts = 0
+	item.NextAttempt = nil
+	item.Error = ""
+	err = q.persist(item)
+	if err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// Sends queued uploads until the handler is closed.
+func (me *HttpHandler) runUploadQueue() {
+	q := me.uploadQueue
+	for {
+		// Uploads interrupted by closing are pending again, and would otherwise be started over.
+		if me.shuttingDown.IsSet() || me.closed.IsSet() {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		item, progress, wait := q.startNext(time.Now(), cancel)
+		if item == nil {
+			cancel()
+			var due <-chan time.Time
+			if wait >= 0 {
+				due = time.After(wait)
+			}
+			select {
+			case <-q.wake:
+			case <-due:
+			case <-me.closed.Done():
+				return
+			case <-me.shuttingDown.Done():
+				return
+			}
+			continue
+		}
+		go func() {
+			select {
+			case <-me.closed.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := me.sendQueuedUpload(ctx, item, progress)
+		cancel()
+		if err != nil {
+			log.Errorf("sending queued upload %q: %v", item.Id, err)
+		}
+		interrupted := me.closed.IsSet()
+		if !interrupted {
+			me.metrics.recordUpload(err != nil)
+		}
+		q.finish(item, err, interrupted)
+	}
+}
+
+func (me *HttpHandler) sendQueuedUpload(ctx context.Context, item *queuedUpload, progress *uploadProgress) error {
+	q := me.uploadQueue
+	files := make([]*os.File, len(item.Paths))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range item.Paths {
+		f, err := os.Open(q.filePath(item.Id, i))
+		if err != nil {
+			return err
+		}
+		files[i] = f
+	}
+	serviceFiles := make([]service.MultiUploadFile, 0, len(item.Paths))
+	for i, filePath := range item.Paths {
+		serviceFiles = append(serviceFiles, service.MultiUploadFile{
+			Path:   filePath,
+			Reader: contextReader{ctx, io.NewSectionReader(files[i], 0, math.MaxInt64)},
+		})
+	}
+	var (
+		output service.UploadOutput
+		err    error
+	)
+	serviceClient := me.uploadServiceClient(ctx, progress)
+	if len(serviceFiles) > 1 {
+		output, err = serviceClient.UploadFiles(item.Name, serviceFiles, item.Options)
+	} else {
+		output, err = serviceClient.Upload(serviceFiles[0].Reader, item.Name, item.Options)
+	}
+	if stdErrors.Is(err, service.ErrUploadInfoMismatch) {
+		return me.rejectUpload(output, item.Options, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !output.Verified {
+		if err := me.verifyUploadLocalCopy(&output, item.Options, files, item.Paths); err != nil {
+			return err
+		}
+	}
+	return me.completeQueuedUpload(item, output, files, progress)
+}
+
+// Stores the upload the same as one from /upload, and records its link on the item. The staged files
+// are moved into the data directory if uploads are kept.
+func (me *HttpHandler) completeQueuedUpload(
+	item *queuedUpload,
+	output service.UploadOutput,
+	files []*os.File,
+	progress *uploadProgress,
+) error {
+	result, err := me.storeCompletedUpload(output, item.Options, files, progress)
+	if err != nil {
+		return err
+	}
+	log.Debugf("queued upload %q is %q", item.Id, result.Link)
+	q := me.uploadQueue
+	q.mu.Lock()
+	item.Link = result.Link
+	q.mu.Unlock()
+	return nil
+}
+
+// Stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (me contextReader) Read(b []byte) (int, error) {
+	if err := me.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return me.r.Read(b)
+}
+
+// GET lists the queue. POST and PUT take an upload in the same form as /upload, stage it and add it
+// to the queue, responding with the queued upload.
+func (me *HttpHandler) handleUploadQueue(rw InstrumentedResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodOptions:
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodGet:
+		return encodeJsonResponse(rw, me.uploadQueue.list())
+	case http.MethodPost, http.MethodPut:
+	default:
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	fileName, sources, uploadOptions, sizeLimit, err := me.policedUploadRequest(r)
+	if err != nil {
+		return err
+	}
+	defer closeUploadSources(sources)
+	item := &queuedUpload{
+		Id:      uuid.New().String(),
+		Name:    fileName,
+		Options: uploadOptions,
+		State:   uploadQueuePending,
+		Added:   time.Now(),
+	}
+	for _, s := range sources {
+		item.Paths = append(item.Paths, s.path)
+	}
+	rw.Set("upload_queue_id", item.Id)
+	err = me.uploadQueue.stage(item, sources)
+	if sizeLimit.Exceeded() {
+		return sizeLimit.err()
+	}
+	if err != nil {
+		return errors.New("staging upload: %v", err)
+	}
+	// The queue owns the item once it's added.
+	queued := *item
+	err = me.uploadQueue.add(item)
+	if err != nil {
+		os.RemoveAll(me.uploadQueue.itemDir(item.Id))
+		return errors.New("adding upload to queue: %v", err)
+	}
+	return encodeJsonResponse(rw, queued)
+}
+
+func (me *HttpHandler) handleUploadQueueCancel(rw InstrumentedResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	id := r.FormValue("id")
+	rw.Set("upload_queue_id", id)
+	err := me.uploadQueue.cancel(id)
+	if err != nil {
+		return err
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (me *HttpHandler) handleUploadQueueRetry(rw InstrumentedResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	id := r.FormValue("id")
+	rw.Set("upload_queue_id", id)
+	err := me.uploadQueue.retry(id)
+	if err != nil {
+		return err
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
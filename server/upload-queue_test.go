@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	stdErrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+// Holds uploads to srv until release is called, keeping queued uploads in the queue.
+func holdUploads(srv *servicetest.Server) (release func()) {
+	released := make(chan struct{})
+	srv.SetFailureHook(func(r *http.Request) int {
+		if strings.HasPrefix(r.URL.Path, "/upload") {
+			<-released
+		}
+		return 0
+	})
+	return sync.OnceFunc(func() { close(released) })
+}
+
+func enqueueUpload(t *testing.T, handler *HttpHandler, name, content string) queuedUpload {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/uploads/queue?name="+name, strings.NewReader(content))
+	require.NoError(t, handler.handleUploadQueue(&NoopInstrumentedResponseWriter{w}, r))
+	var item queuedUpload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &item))
+	return item
+}
+
+func waitForUploadQueue(t *testing.T, handler *HttpHandler, cond func([]queuedUpload) bool) {
+	require.Eventually(t, func() bool {
+		return cond(handler.uploadQueue.list())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUploadQueue(t *testing.T) {
+	oldRetryDelay := uploadQueueRetryDelay
+	uploadQueueRetryDelay = 0
+	t.Cleanup(func() { uploadQueueRetryDelay = oldRetryDelay })
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+
+	// Rejections aren't retried.
+	srv.SetFailureHook(servicetest.FailRequests("/upload", http.StatusForbidden, 0))
+	item := enqueueUpload(t, handler, "file.txt", "file content")
+	assert.Equal(t, uploadQueuePending, item.State)
+	waitForUploadQueue(t, handler, func(items []queuedUpload) bool {
+		return len(items) == 1 && items[0].State == uploadQueueFailed
+	})
+	failed := handler.uploadQueue.list()[0]
+	assert.Equal(t, 1, failed.Attempts)
+	assert.NotEmpty(t, failed.Error)
+	assert.Empty(t, srv.Objects())
+
+	srv.SetFailureHook(nil)
+	require.NoError(t, handler.uploadQueue.retry(item.Id))
+	waitForUploadQueue(t, handler, func(items []queuedUpload) bool { return len(items) == 0 })
+	objects := srv.Objects()
+	require.Len(t, objects, 1)
+	assert.FileExists(t, filepath.Join(handler.uploadsDir, objects[0].Prefix.PrefixString()+".torrent"))
+	token, err := handler.UploadTokenStore.Get(objects[0].Prefix)
+	require.NoError(t, err)
+	assert.Equal(t, objects[0].AdminToken, token)
+	assert.NoDirExists(t, handler.uploadQueue.itemDir(item.Id))
+
+	// Unavailability is retried.
+	srv.SetFailureHook(servicetest.FailRequests("/upload", http.StatusServiceUnavailable, 2))
+	enqueueUpload(t, handler, "other.txt", "other content")
+	waitForUploadQueue(t, handler, func(items []queuedUpload) bool { return len(items) == 0 })
+	assert.Len(t, srv.Objects(), 2)
+}
+
+func TestUploadQueueCancel(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	release := holdUploads(srv)
+	defer release()
+	handler := newServicetestHandler(t, srv, nil)
+	// The first upload holds up the queue.
+	first := enqueueUpload(t, handler, "first.txt", "first content")
+	require.Eventually(t, func() bool {
+		return handler.uploadQueue.currentId() == first.Id
+	}, 5*time.Second, time.Millisecond)
+	item := enqueueUpload(t, handler, "file.txt", "file content")
+	assert.DirExists(t, handler.uploadQueue.itemDir(item.Id))
+	require.NoError(t, handler.uploadQueue.cancel(item.Id))
+	items := handler.uploadQueue.list()
+	require.Len(t, items, 1)
+	assert.Equal(t, first.Id, items[0].Id)
+	assert.NoDirExists(t, handler.uploadQueue.itemDir(item.Id))
+	var he handlerError
+	require.ErrorAs(t, handler.uploadQueue.cancel(item.Id), &he)
+	assert.Equal(t, http.StatusNotFound, he.statusCode)
+}
+
+func TestUploadQueueSurvivesRestart(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	release := holdUploads(srv)
+	defer release()
+	handler := newServicetestHandler(t, srv, nil)
+	item := enqueueUpload(t, handler, "file.txt", "file content")
+	require.Eventually(t, func() bool {
+		return handler.uploadQueue.currentId() == item.Id
+	}, 5*time.Second, time.Millisecond)
+	// As if the app stopped while the upload was in progress.
+	rootUploadsDir := t.TempDir()
+	queueDir := filepath.Join(rootUploadsDir, "replica", "upload-queue")
+	require.NoError(t, os.CopyFS(queueDir, os.DirFS(handler.uploadQueue.dir)))
+	require.NoError(t, handler.uploadQueue.cancel(item.Id))
+	release()
+	entries, err := os.ReadDir(queueDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	handler = newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		input.RootUploadsDir = rootUploadsDir
+	})
+	waitForUploadQueue(t, handler, func(items []queuedUpload) bool { return len(items) == 0 })
+	require.Len(t, srv.Objects(), 1)
+	assert.Equal(t, [][]byte{[]byte("file content")}, srv.Objects()[0].Data)
+}
+
+// Finished queued uploads are stored, and their links recorded.
+func TestUploadQueueLink(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	release := holdUploads(srv)
+	defer release()
+	handler := newServicetestHandler(t, srv, nil)
+	item := enqueueUpload(t, handler, "file.txt", "file content")
+	handler.uploadQueue.mu.Lock()
+	queued := handler.uploadQueue.items[item.Id]
+	handler.uploadQueue.mu.Unlock()
+	release()
+	waitForUploadQueue(t, handler, func(items []queuedUpload) bool { return len(items) == 0 })
+
+	require.Len(t, srv.Objects(), 1)
+	existing := srv.Objects()[0]
+	assert.FileExists(t, filepath.Join(handler.uploadsDir, existing.Prefix.PrefixString()+".torrent"))
+	handler.uploadQueue.mu.Lock()
+	link := queued.Link
+	handler.uploadQueue.mu.Unlock()
+	m, err := metainfo.ParseMagnetUri(link)
+	require.NoError(t, err)
+	assert.Equal(t, existing.InfoHash, m.InfoHash)
+}
+
+// Cancelling isn't held up by the upload waiting on the rate limit.
+func TestUploadQueueCancelRateLimited(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, func(input *NewHttpHandlerInput) {
+		// After the first burst, each read waits 32s.
+		input.ReplicaServiceClient.UploadRateLimiter = rate.NewLimiter(1<<10, 32<<10)
+	})
+	item := enqueueUpload(t, handler, "file.txt", strings.Repeat("a", 128<<10))
+	require.Eventually(t, func() bool {
+		return handler.uploadQueue.currentId() == item.Id
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, handler.uploadQueue.cancel(item.Id))
+	require.Eventually(t, func() bool {
+		return handler.uploadQueue.currentId() == ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, srv.Objects())
+}
+
+// Uploads keep being tried while the service can't be reached, but not while it's failing.
+func TestUploadQueueRetryLimit(t *testing.T) {
+	q, err := openUploadQueue(t.TempDir(), 2)
+	require.NoError(t, err)
+	item := &queuedUpload{Id: "id", State: uploadQueueInProgress, Attempts: 100}
+	q.items[item.Id] = item
+	unreachable := &service.Error{
+		Category:  service.ErrorCategoryUpstreamUnavailable,
+		Retryable: true,
+		Err:       stdErrors.New("dial tcp: connection refused"),
+	}
+	q.finish(item, unreachable, false)
+	assert.Equal(t, uploadQueuePending, item.State)
+	require.NotNil(t, item.NextAttempt)
+	assert.False(t, item.NextAttempt.After(time.Now().Add(maxUploadQueueRetryDelay)))
+
+	item.Attempts = 2
+	unavailable := &service.Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Category:   service.ErrorCategoryUpstreamUnavailable,
+		Retryable:  true,
+	}
+	q.finish(item, unavailable, false)
+	assert.Equal(t, uploadQueueFailed, item.State)
+}
+
+func TestUploadQueueMethods(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	release := holdUploads(srv)
+	defer release()
+	handler := newServicetestHandler(t, srv, nil)
+	item := enqueueUpload(t, handler, "file.txt", "file content")
+	for _, h := range []func(InstrumentedResponseWriter, *http.Request) error{
+		handler.handleUploadQueueCancel,
+		handler.handleUploadQueueRetry,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?id="+item.Id, nil)
+		var he handlerError
+		require.ErrorAs(t, h(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, r), &he)
+		assert.Equal(t, http.StatusMethodNotAllowed, he.statusCode)
+	}
+	assert.Len(t, handler.uploadQueue.list(), 1)
+	r := httptest.NewRequest(http.MethodPost, "/?id="+item.Id, nil)
+	require.NoError(t, handler.handleUploadQueueCancel(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, r))
+	assert.Empty(t, handler.uploadQueue.list())
+}
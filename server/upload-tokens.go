@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	stdErrors "errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/replica/service"
+)
+
+// UploadTokenStore persists the admin tokens for our uploads. Get should return an error wrapping
+// fs.ErrNotExist if there's no token for the prefix.
+type UploadTokenStore interface {
+	Get(prefix service.Prefix) (string, error)
+	Put(prefix service.Prefix, token string) error
+	Delete(prefix service.Prefix) error
+}
+
+// Marks token files that are encrypted. Older token files are the bare token.
+const encryptedUploadTokenPrefix = "replica-token-v1:"
+
+// Keeps each token in <prefix>.token in dir, encrypted with a key derived from secret. Any
+// plaintext tokens already in dir are encrypted.
+func NewUploadTokenStore(dir string, secret []byte) (UploadTokenStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("no upload token secret")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("replica upload token encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	store := &fileUploadTokenStore{dir: dir}
+	store.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	store.migrate()
+	return store, nil
+}
+
+type fileUploadTokenStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+func (me *fileUploadTokenStore) path(prefix service.Prefix) string {
+	return filepath.Join(me.dir, prefix.PrefixString()+".token")
+}
+
+func (me *fileUploadTokenStore) Get(prefix service.Prefix) (string, error) {
+	b, err := os.ReadFile(me.path(prefix))
+	if err != nil {
+		return "", err
+	}
+	encoded, encrypted := bytes.CutPrefix(b, []byte(encryptedUploadTokenPrefix))
+	if !encrypted {
+		// Left over from before encryption, if migrating it failed.
+		return string(b), nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return "", errors.New("decoding upload token: %v", err)
+	}
+	nonceSize := me.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("upload token too short")
+	}
+	// The prefix is authenticated so tokens can't be swapped between uploads.
+	token, err := me.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(prefix))
+	if err != nil {
+		return "", errors.New("decrypting upload token: %v", err)
+	}
+	return string(token), nil
+}
+
+func (me *fileUploadTokenStore) Put(prefix service.Prefix, token string) error {
+	nonce := make([]byte, me.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := me.aead.Seal(nonce, nonce, []byte(token), []byte(prefix))
+	b := []byte(encryptedUploadTokenPrefix + base64.RawStdEncoding.EncodeToString(sealed))
+	path := me.path(prefix)
+	tmpPath := path + ".tmp"
+	// Left over from a failed attempt, and read-only.
+	os.Remove(tmpPath)
+	err := os.WriteFile(tmpPath, b, 0o440)
+	if err != nil {
+		return err
+	}
+	// The token files are read-only, which upsets renaming over them on some platforms.
+	os.Remove(path)
+	return os.Rename(tmpPath, path)
+}
+
+func (me *fileUploadTokenStore) Delete(prefix service.Prefix) error {
+	return os.Remove(me.path(prefix))
+}
+
+// Encrypts any plaintext tokens left from before tokens were encrypted.
+func (me *fileUploadTokenStore) migrate() {
+	entries, err := os.ReadDir(me.dir)
+	if isNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("reading upload tokens dir: %v", err)
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || filepath.Ext(name) != ".token" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(me.dir, name))
+		if err == nil && !bytes.HasPrefix(b, []byte(encryptedUploadTokenPrefix)) {
+			err = me.Put(service.Prefix(strings.TrimSuffix(name, ".token")), string(b))
+		}
+		if err != nil {
+			log.Errorf("migrating upload token %q: %v", name, err)
+		}
+	}
+}
+
+func isNotExist(err error) bool {
+	return stdErrors.Is(err, fs.ErrNotExist)
+}
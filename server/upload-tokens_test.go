@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func TestUploadTokenStoreMigratesPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "prefix.token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("admin-token"), 0o440))
+
+	store, err := NewUploadTokenStore(dir, []byte("secret"))
+	require.NoError(t, err)
+	b, err := os.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "admin-token")
+	token, err := store.Get("prefix")
+	require.NoError(t, err)
+	assert.Equal(t, "admin-token", token)
+
+	other, err := NewUploadTokenStore(dir, []byte("other secret"))
+	require.NoError(t, err)
+	_, err = other.Get("prefix")
+	assert.Error(t, err)
+	// Encrypted tokens are bound to their prefix.
+	require.NoError(t, os.Rename(tokenPath, filepath.Join(dir, "moved.token")))
+	_, err = store.Get("moved")
+	assert.Error(t, err)
+
+	_, err = store.Get("missing")
+	assert.True(t, isNotExist(err))
+	require.NoError(t, store.Put("prefix", "new-token"))
+	token, err = store.Get("prefix")
+	require.NoError(t, err)
+	assert.Equal(t, "new-token", token)
+	require.NoError(t, store.Delete("prefix"))
+	_, err = store.Get("prefix")
+	assert.True(t, isNotExist(err))
+}
+
+// Tokens aren't kept without a secret, since one generated and kept beside them wouldn't protect
+// them.
+func TestUploadTokenSecretRequired(t *testing.T) {
+	dir := t.TempDir()
+	newHandler := func(secret []byte) (*HttpHandler, error) {
+		input := NewHttpHandlerInput{}
+		input.SetDefaults()
+		input.RootUploadsDir = dir
+		input.CacheDir = t.TempDir()
+		input.UploadTokenSecret = secret
+		return NewHTTPHandler(input)
+	}
+	_, err := newHandler(nil)
+	assert.Error(t, err)
+	uploadsDir := filepath.Join(dir, "replica", "uploads")
+	require.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "old.token"), []byte("old-token"), 0o440))
+	handler, err := newHandler([]byte("secret"))
+	require.NoError(t, err)
+	handler.Close()
+	b, err := os.ReadFile(filepath.Join(uploadsDir, "old.token"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), encryptedUploadTokenPrefix))
+	token, err := handler.UploadTokenStore.Get("old")
+	require.NoError(t, err)
+	assert.Equal(t, "old-token", token)
+}
+
+// Only the constructor migrates plaintext tokens.
+func TestUploadTokenStoreGetDoesNotWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewUploadTokenStore(dir, []byte("secret"))
+	require.NoError(t, err)
+	tokenPath := filepath.Join(dir, "prefix.token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("admin-token"), 0o440))
+	token, err := store.Get("prefix")
+	require.NoError(t, err)
+	assert.Equal(t, "admin-token", token)
+	b, err := os.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, "admin-token", string(b))
+}
+
+// A token we can't read is an error, and not a reason to delete as though we never had one.
+func TestDeleteWithUnreadableToken(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/upload?name=file", strings.NewReader("content"))
+	require.NoError(t, handler.handleUpload(&NoopInstrumentedResponseWriter{w}, r))
+	var oi objectInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &oi))
+	prefix := srv.Objects()[0].Prefix
+	other, err := NewUploadTokenStore(handler.uploadsDir, []byte("other secret"))
+	require.NoError(t, err)
+	require.NoError(t, other.Put(prefix, "token"))
+
+	d := httptest.NewRequest(http.MethodGet, "/delete?"+url.Values{"link": {oi.Link}}.Encode(), nil)
+	assert.Error(t, handler.handleDelete(&NoopInstrumentedResponseWriter{httptest.NewRecorder()}, d))
+	assert.Len(t, srv.Objects(), 1)
+	assert.FileExists(t, filepath.Join(handler.uploadsDir, prefix.PrefixString()+".token"))
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/getlantern/replica/service"
+)
+
+// An uploads bundle is a tar of the files that make up upload ownership, sealed with a key derived
+// from a passphrase:
+//
+//	magic | scrypt salt | AES-GCM nonce | AES-GCM(tar), with the magic and salt as additional data
+const uploadsBundleMagic = "replica-uploads-bundle-v1\n"
+
+const (
+	uploadsBundleSaltSize = 32
+	// The bundle is read into memory, so don't let it get silly.
+	maxUploadsBundleSize = 64 << 20
+)
+
+// The scrypt cost. This is a var for tests.
+var uploadsBundleScryptN = 1 << 15
+
+// The files in bundles. Options were added later, so they're optional.
+var uploadsBundleEntryRegexp = regexp.MustCompile(`^[^/\\]+\.(torrent|token|json)$`)
+
+var errUploadsBundlePassphrase = errors.New("wrong passphrase or corrupt bundle")
+
+func uploadsBundleKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, uploadsBundleScryptN, 8, 1, 32)
+}
+
+func sealUploadsBundle(passphrase string, plaintext []byte) ([]byte, error) {
+	header := make([]byte, len(uploadsBundleMagic)+uploadsBundleSaltSize)
+	copy(header, uploadsBundleMagic)
+	salt := header[len(uploadsBundleMagic):]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newUploadsBundleAead(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ret := append(header, nonce...)
+	return aead.Seal(ret, nonce, plaintext, header), nil
+}
+
+func openUploadsBundle(passphrase string, bundle []byte) ([]byte, error) {
+	headerLen := len(uploadsBundleMagic) + uploadsBundleSaltSize
+	if len(bundle) < headerLen || string(bundle[:len(uploadsBundleMagic)]) != uploadsBundleMagic {
+		return nil, errors.New("not an uploads bundle")
+	}
+	header := bundle[:headerLen]
+	aead, err := newUploadsBundleAead(passphrase, header[len(uploadsBundleMagic):])
+	if err != nil {
+		return nil, err
+	}
+	rest := bundle[headerLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errUploadsBundlePassphrase
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, errUploadsBundlePassphrase
+	}
+	return plaintext, nil
+}
+
+func newUploadsBundleAead(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := uploadsBundleKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The passphrase must be in a POSTed form, so it isn't in a URL that ends up in logs or history.
+func uploadsBundlePassphrase(r *http.Request) (string, error) {
+	if r.Method != http.MethodPost {
+		return "", handlerError{http.StatusMethodNotAllowed, errors.New("unexpected method %q", r.Method)}
+	}
+	passphrase := r.PostFormValue("passphrase")
+	if passphrase == "" {
+		return "", handlerError{http.StatusBadRequest, errors.New("passphrase is required")}
+	}
+	return passphrase, nil
+}
+
+// Responds with a bundle of the metainfos, admin tokens and options for our uploads.
+func (me *HttpHandler) handleUploadsExport(rw InstrumentedResponseWriter, r *http.Request) error {
+	passphrase, err := uploadsBundlePassphrase(r)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(me.uploadsDir)
+	if err != nil && !isNotExist(err) {
+		return errors.New("reading uploads dir: %v", err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	count := 0
+	addFile := func(name string, b []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0o600,
+			Size:    int64(len(b)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		count++
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || filepath.Ext(name) != ".torrent" {
+			continue
+		}
+		prefix := service.Prefix(strings.TrimSuffix(name, ".torrent"))
+		b, err := os.ReadFile(filepath.Join(me.uploadsDir, name))
+		if err != nil {
+			return errors.New("reading %q: %v", name, err)
+		}
+		if err := addFile(name, b); err != nil {
+			return err
+		}
+		// Tokens go in the bundle decrypted, since the bundle has its own encryption.
+		token, err := me.UploadTokenStore.Get(prefix)
+		if err == nil {
+			err = addFile(prefix.PrefixString()+".token", []byte(token))
+			if err != nil {
+				return err
+			}
+		} else if !isNotExist(err) {
+			log.Errorf("getting upload token for %q: %v", prefix, err)
+		}
+		b, err = os.ReadFile(me.uploadOptionsPath(prefix))
+		if err == nil {
+			err = addFile(prefix.PrefixString()+".json", b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	bundle, err := sealUploadsBundle(passphrase, buf.Bytes())
+	if err != nil {
+		return errors.New("sealing bundle: %v", err)
+	}
+	rw.Set("files", count)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", `attachment; filename="replica-uploads.bundle"`)
+	_, err = rw.Write(bundle)
+	return err
+}
+
+// How an import went for each upload in the bundle.
+type uploadsImportResult struct {
+	Imported []service.Prefix `json:"imported"`
+	// Already present with the same content.
+	Unchanged []service.Prefix `json:"unchanged"`
+	// Present with different content, and left alone.
+	Conflicts []service.Prefix `json:"conflicts"`
+	// Files that weren't used, because they didn't belong to an upload with a valid metainfo.
+	Invalid []string `json:"invalid"`
+}
+
+// Restores uploads from a bundle created by handleUploadsExport. The bundle is the "bundle" file in
+// a multipart form, with the passphrase alongside. Uploads we already have with different content
+// are reported as conflicts, unless "replace" is true.
+func (me *HttpHandler) handleUploadsImport(rw InstrumentedResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(rw, r.Body, maxUploadsBundleSize+1<<20)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("parsing form: %v", err)}
+	}
+	passphrase, err := uploadsBundlePassphrase(r)
+	if err != nil {
+		return err
+	}
+	replace := r.FormValue("replace") == "true"
+	f, _, err := r.FormFile("bundle")
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("getting bundle: %v", err)}
+	}
+	defer f.Close()
+	bundle, err := io.ReadAll(io.LimitReader(f, maxUploadsBundleSize+1))
+	if err != nil {
+		return errors.New("reading bundle: %v", err)
+	}
+	if len(bundle) > maxUploadsBundleSize {
+		return handlerError{http.StatusRequestEntityTooLarge, errors.New("bundle too large")}
+	}
+	plaintext, err := openUploadsBundle(passphrase, bundle)
+	if err != nil {
+		return handlerError{http.StatusBadRequest, err}
+	}
+	files, err := readUploadsBundleFiles(plaintext)
+	if err != nil {
+		return handlerError{http.StatusBadRequest, errors.New("reading bundle contents: %v", err)}
+	}
+	result, err := me.importUploads(files, replace)
+	if err != nil {
+		return err
+	}
+	rw.Set("imported", len(result.Imported))
+	return encodeJsonResponse(rw, result)
+}
+
+// Returns the bundle files by name, ignoring anything that we wouldn't have exported.
+func readUploadsBundleFiles(tarBytes []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(tarBytes))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || !uploadsBundleEntryRegexp.MatchString(h.Name) {
+			log.Errorf("ignoring uploads bundle entry %q", h.Name)
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[h.Name] = b
+	}
+}
+
+// Writes each upload with a valid metainfo into the uploads dir, along with its token and options.
+func (me *HttpHandler) importUploads(files map[string][]byte, replace bool) (result uploadsImportResult, err error) {
+	// Ensure not nil, for the JSON response.
+	result = uploadsImportResult{
+		Imported:  []service.Prefix{},
+		Unchanged: []service.Prefix{},
+		Conflicts: []service.Prefix{},
+		Invalid:   []string{},
+	}
+	// Staged next to the uploads dir, so the files can be renamed into place.
+	stagingDir, err := os.MkdirTemp(filepath.Dir(me.uploadsDir), "uploads-import-")
+	if err != nil {
+		return result, errors.New("creating staging dir: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	for name, b := range files {
+		if filepath.Ext(name) != ".torrent" {
+			continue
+		}
+		err = os.WriteFile(filepath.Join(stagingDir, name), b, 0o600)
+		if err != nil {
+			return result, errors.New("staging %q: %v", name, err)
+		}
+	}
+	valid := make(map[service.Prefix]bool)
+	err = service.IterUploads(stagingDir, func(iu service.IteredUpload) {
+		if iu.Err != nil {
+			log.Errorf("invalid upload in bundle: %v", iu.Err)
+			return
+		}
+		if !uploadMetainfoMatchesPrefix(iu.Metainfo) {
+			log.Errorf("upload %q in bundle has a metainfo for another upload", iu.Metainfo.Upload.Prefix)
+			return
+		}
+		valid[iu.Metainfo.Upload.Prefix] = true
+	})
+	if err != nil {
+		return result, errors.New("validating bundle uploads: %v", err)
+	}
+	for name := range files {
+		prefix := service.Prefix(strings.TrimSuffix(name, filepath.Ext(name)))
+		if !valid[prefix] {
+			result.Invalid = append(result.Invalid, name)
+		}
+	}
+	for prefix := range valid {
+		var state uploadImportState
+		state, err = me.importUpload(prefix, files, replace)
+		if err != nil {
+			return result, errors.New("importing %q: %v", prefix, err)
+		}
+		switch state {
+		case uploadImported:
+			result.Imported = append(result.Imported, prefix)
+		case uploadUnchanged:
+			result.Unchanged = append(result.Unchanged, prefix)
+		case uploadConflict:
+			result.Conflicts = append(result.Conflicts, prefix)
+		}
+	}
+	slices.Sort(result.Imported)
+	slices.Sort(result.Unchanged)
+	slices.Sort(result.Conflicts)
+	slices.Sort(result.Invalid)
+	return
+}
+
+// Whether the metainfo is for the upload it's stored as, by the infohash or the prefix. Tokens are
+// stored by the same prefix, so this stops an upload's token being paired with another's metainfo.
+func uploadMetainfoMatchesPrefix(umi service.UploadMetainfo) bool {
+	prefix := umi.Upload.Prefix.PrefixString()
+	return strings.EqualFold(prefix, umi.HashInfoBytes().HexString()) ||
+		prefix == umi.Info.Name ||
+		umi.Comment == service.ExactSource(umi.Upload.Prefix)
+}
+
+type uploadImportState int
+
+const (
+	uploadImported uploadImportState = iota
+	uploadUnchanged
+	uploadConflict
+)
+
+func (me *HttpHandler) importUpload(prefix service.Prefix, files map[string][]byte, replace bool) (uploadImportState, error) {
+	upload := service.Upload{UploadPrefix: service.UploadPrefix{Prefix: prefix}}
+	read := func(ext string) ([]byte, error) {
+		switch ext {
+		case ".token":
+			token, err := me.UploadTokenStore.Get(prefix)
+			return []byte(token), err
+		case ".json":
+			return os.ReadFile(me.uploadOptionsPath(prefix))
+		default:
+			return os.ReadFile(me.uploadMetainfoPath(upload))
+		}
+	}
+	// Write the metainfo last, since that's what makes the upload show up.
+	exts := []string{".token", ".json", ".torrent"}
+	changed := false
+	for _, ext := range exts {
+		b, ok := files[prefix.PrefixString()+ext]
+		if !ok {
+			continue
+		}
+		existing, err := read(ext)
+		if err == nil && bytes.Equal(existing, b) {
+			continue
+		}
+		// Something we can't read, like a token encrypted with another secret, is also a conflict.
+		if !isNotExist(err) && !replace {
+			return uploadConflict, nil
+		}
+		changed = true
+	}
+	if !changed {
+		return uploadUnchanged, nil
+	}
+	for _, ext := range exts {
+		b, ok := files[prefix.PrefixString()+ext]
+		if !ok {
+			continue
+		}
+		if ext == ".token" {
+			err := me.UploadTokenStore.Put(prefix, string(b))
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		path := me.uploadOptionsPath(prefix)
+		if ext == ".torrent" {
+			path = me.uploadMetainfoPath(upload)
+		}
+		tmpPath := path + ".tmp"
+		err := os.WriteFile(tmpPath, b, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		err = os.Rename(tmpPath, path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return uploadImported, nil
+}
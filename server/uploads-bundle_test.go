@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+	"github.com/getlantern/replica/service/servicetest"
+)
+
+func writeTestUpload(t *testing.T, handler *HttpHandler, prefix service.Prefix, token string) {
+	info := metainfo.Info{
+		Name:        prefix.PrefixString(),
+		PieceLength: 1 << 18,
+		Files:       []metainfo.FileInfo{{Path: []string{"file"}, Length: 1}},
+		Pieces:      make([]byte, 20),
+	}
+	mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+	upload := service.Upload{UploadPrefix: service.UploadPrefix{Prefix: prefix}}
+	require.NoError(t, os.WriteFile(handler.uploadMetainfoPath(upload), bencode.MustMarshal(mi), 0o600))
+	require.NoError(t, handler.UploadTokenStore.Put(prefix, token))
+}
+
+func exportUploadsBundle(t *testing.T, handler *HttpHandler, passphrase string) []byte {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/uploads/export", strings.NewReader(url.Values{"passphrase": {passphrase}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	require.NoError(t, handler.handleUploadsExport(&NoopInstrumentedResponseWriter{w}, r))
+	return w.Body.Bytes()
+}
+
+func importUploadsBundle(handler *HttpHandler, bundle []byte, passphrase string, replace bool) (result uploadsImportResult, err error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("passphrase", passphrase)
+	if replace {
+		mw.WriteField("replace", "true")
+	}
+	fw, _ := mw.CreateFormFile("bundle", "replica-uploads.bundle")
+	fw.Write(bundle)
+	mw.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/uploads/import", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	err = handler.handleUploadsImport(&NoopInstrumentedResponseWriter{w}, r)
+	if err == nil {
+		err = json.Unmarshal(w.Body.Bytes(), &result)
+	}
+	return
+}
+
+func TestUploadsExportImport(t *testing.T) {
+	uploadsBundleScryptN = 1 << 4
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	withTokenSecret := func(secret string) func(*NewHttpHandlerInput) {
+		return func(input *NewHttpHandlerInput) {
+			input.UploadTokenSecret = []byte(secret)
+		}
+	}
+	src := newServicetestHandler(t, srv, withTokenSecret("src secret"))
+	writeTestUpload(t, src, "a", "token-a")
+	writeTestUpload(t, src, "b", "token-b")
+	require.NoError(t, src.storeUploadOptions("a", service.UploadOptions{Title: "title"}))
+	// Not a valid metainfo, so it shouldn't be imported.
+	require.NoError(t, os.WriteFile(filepath.Join(src.uploadsDir, "c.torrent"), []byte("garbage"), 0o600))
+	require.NoError(t, src.UploadTokenStore.Put("c", "token-c"))
+	// A valid metainfo, but for another upload than the token it's paired with.
+	b, err := os.ReadFile(src.uploadMetainfoPath(service.Upload{UploadPrefix: service.UploadPrefix{Prefix: "a"}}))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src.uploadsDir, "d.torrent"), b, 0o600))
+	require.NoError(t, src.UploadTokenStore.Put("d", "token-d"))
+	bundle := exportUploadsBundle(t, src, "hunter2")
+	assert.NotContains(t, string(bundle), "token-a")
+
+	// Tokens are encrypted differently on each device.
+	dst := newServicetestHandler(t, srv, withTokenSecret("dst secret"))
+	_, err = importUploadsBundle(dst, bundle, "wrong", false)
+	var he handlerError
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+
+	// Something different to what's in the bundle.
+	writeTestUpload(t, dst, "b", "other-token")
+	result, err := importUploadsBundle(dst, bundle, "hunter2", false)
+	require.NoError(t, err)
+	assert.Equal(t, []service.Prefix{"a"}, result.Imported)
+	assert.Equal(t, []service.Prefix{"b"}, result.Conflicts)
+	assert.Equal(t, []string{"c.token", "c.torrent", "d.token", "d.torrent"}, result.Invalid)
+	token, err := dst.UploadTokenStore.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "token-a", token)
+	uo, _, err := dst.loadUploadOptions("a")
+	require.NoError(t, err)
+	assert.Equal(t, "title", uo.Title)
+	token, err = dst.UploadTokenStore.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, "other-token", token)
+	_, err = dst.UploadTokenStore.Get("c")
+	assert.True(t, isNotExist(err))
+	_, err = dst.UploadTokenStore.Get("d")
+	assert.True(t, isNotExist(err))
+
+	result, err = importUploadsBundle(dst, bundle, "hunter2", true)
+	require.NoError(t, err)
+	assert.Equal(t, []service.Prefix{"b"}, result.Imported)
+	assert.Equal(t, []service.Prefix{"a"}, result.Unchanged)
+	token, err = dst.UploadTokenStore.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, "token-b", token)
+}
+
+func TestUploadsExportRequiresPost(t *testing.T) {
+	srv := servicetest.NewServer()
+	defer srv.Close()
+	handler := newServicetestHandler(t, srv, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/uploads/export?passphrase=hunter2", nil)
+	err := handler.handleUploadsExport(&NoopInstrumentedResponseWriter{w}, r)
+	var he handlerError
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusMethodNotAllowed, he.statusCode)
+	// Not from the query string, even when POSTing.
+	r = httptest.NewRequest(http.MethodPost, "/uploads/export?passphrase=hunter2", nil)
+	err = handler.handleUploadsExport(&NoopInstrumentedResponseWriter{w}, r)
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusBadRequest, he.statusCode)
+	assert.Zero(t, w.Body.Len())
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How long an endpoint is passed over after failing. This doubles for each consecutive failure.
+const endpointFailureCooldown = 10 * time.Second
+
+const maxEndpointFailureCooldown = 5 * time.Minute
+
+// Weight given to the latest latency observation in the moving average.
+const endpointLatencyWeight = 0.2
+
+// EndpointHealth tracks failures and latency for equivalent service endpoints, so that requests
+// go to endpoints that are working. The zero value is ready to use, and a nil *EndpointHealth
+// tracks nothing.
+type EndpointHealth struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+type EndpointStats struct {
+	Url                 string
+	Successes           int64
+	Failures            int64
+	ConsecutiveFailures int
+	LastFailure         time.Time
+	// Moving average of the time taken to get a response.
+	Latency time.Duration
+}
+
+func (me *EndpointStats) cooldownUntil() time.Time {
+	if me.ConsecutiveFailures == 0 {
+		return time.Time{}
+	}
+	cooldown := endpointFailureCooldown << min(me.ConsecutiveFailures-1, 10)
+	return me.LastFailure.Add(min(cooldown, maxEndpointFailureCooldown))
+}
+
+// Records the outcome of a request to the endpoint. Only errors that suggest the endpoint is
+// unhealthy count as failures.
+func (me *EndpointHealth) Observe(endpoint *url.URL, latency time.Duration, err error) {
+	if me == nil {
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	key := endpoint.String()
+	stats, ok := me.endpoints[key]
+	if !ok {
+		if me.endpoints == nil {
+			me.endpoints = make(map[string]*EndpointStats)
+		}
+		stats = &EndpointStats{Url: key}
+		me.endpoints[key] = stats
+	}
+	if endpointFailed(err) {
+		stats.Failures++
+		stats.ConsecutiveFailures++
+		stats.LastFailure = time.Now()
+		return
+	}
+	stats.Successes++
+	stats.ConsecutiveFailures = 0
+	if stats.Latency == 0 {
+		stats.Latency = latency
+	} else {
+		stats.Latency += time.Duration(endpointLatencyWeight * float64(latency-stats.Latency))
+	}
+}
+
+func endpointFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Retryable
+	}
+	return false
+}
+
+// Returns the endpoints with those that have recently failed moved to the back. Otherwise the
+// given order is preserved.
+func (me *EndpointHealth) Order(endpoints []*url.URL) []*url.URL {
+	if me == nil || len(endpoints) < 2 {
+		return endpoints
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	now := time.Now()
+	cooldownUntil := func(u *url.URL) time.Time {
+		stats, ok := me.endpoints[u.String()]
+		if !ok {
+			return time.Time{}
+		}
+		until := stats.cooldownUntil()
+		if until.Before(now) {
+			return time.Time{}
+		}
+		return until
+	}
+	ret := slices.Clone(endpoints)
+	slices.SortStableFunc(ret, func(a, b *url.URL) int {
+		return cooldownUntil(a).Compare(cooldownUntil(b))
+	})
+	return ret
+}
+
+// A snapshot of the stats for each endpoint that has been used.
+func (me *EndpointHealth) Stats() (ret []EndpointStats) {
+	if me == nil {
+		return nil
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, stats := range me.endpoints {
+		ret = append(ret, *stats)
+	}
+	slices.SortFunc(ret, func(a, b EndpointStats) int {
+		if a.Url < b.Url {
+			return -1
+		}
+		if a.Url > b.Url {
+			return 1
+		}
+		return 0
+	})
+	return
+}
+
+// The service endpoints in the order they should be tried.
+func (cl ServiceClient) Endpoints() []*url.URL {
+	var endpoints []*url.URL
+	if cl.ReplicaServiceEndpoints != nil {
+		endpoints = cl.ReplicaServiceEndpoints()
+	}
+	if len(endpoints) == 0 {
+		endpoints = []*url.URL{cl.ReplicaServiceEndpoint()}
+	}
+	return cl.EndpointHealth.Order(endpoints)
+}
+
+// How a request may be repeated when it fails.
+type requestRetry int
+
+const (
+	// The request is safe to repeat, like a GET or putting an upload part.
+	retryIdempotent requestRetry = iota
+	// The request is only repeated if it couldn't have reached the service.
+	retryUnsent
+	// The request body can't be replayed, so there's only one attempt.
+	retryNever
+)
+
+// The least number of attempts at a request. With more endpoints than this, each gets an attempt.
+// For resumable uploads, the session state remains on disk after the last attempt, so the next
+// upload of the same content picks up from there.
+const maxRequestAttempts = 3
+
+// Multiplied by the attempt number to wait between attempts once every endpoint has failed. This is
+// a var for tests.
+var requestRetryDelay = time.Second
+
+func (me requestRetry) allows(err error) bool {
+	var serviceErr *Error
+	if !errors.As(err, &serviceErr) || !serviceErr.Retryable {
+		return false
+	}
+	switch me {
+	case retryIdempotent:
+		return true
+	case retryUnsent:
+		var opErr *net.OpError
+		return serviceErr.StatusCode == 0 && errors.As(serviceErr.Err, &opErr) && opErr.Op == "dial"
+	default:
+		return false
+	}
+}
+
+// Does the request created by newRequest against the healthiest endpoint, failing over to the others
+// and retrying with backoff as allowed by retry.
+func (cl ServiceClient) doWithRetries(
+	retry requestRetry,
+	newRequest func(endpoint *url.URL) (*http.Request, error),
+) (respBody []byte, err error) {
+	tried := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		endpoints := cl.Endpoints()
+		var endpoint *url.URL
+		for _, e := range endpoints {
+			if !tried[e.String()] {
+				endpoint = e
+				break
+			}
+		}
+		if endpoint == nil {
+			// Everything has failed. Wait a bit before going around again.
+			clear(tried)
+			select {
+			case <-time.After(time.Duration(attempt-1) * requestRetryDelay):
+			case <-cl.context().Done():
+				return nil, cl.context().Err()
+			}
+			endpoint = endpoints[0]
+		}
+		tried[endpoint.String()] = true
+		var req *http.Request
+		req, err = newRequest(endpoint)
+		if err != nil {
+			return
+		}
+		req = req.WithContext(cl.context())
+		started := time.Now()
+		respBody, err = cl.doRequest(req)
+		// Being cancelled says nothing about the endpoint.
+		if cl.context().Err() == nil {
+			cl.EndpointHealth.Observe(endpoint, time.Since(started), err)
+		}
+		if err == nil || !retry.allows(err) || attempt >= max(maxRequestAttempts, len(endpoints)) || cl.context().Err() != nil {
+			return
+		}
+		log.Debugf("attempt %v of %v %v failed: %v", attempt, req.Method, req.URL, err)
+	}
+}
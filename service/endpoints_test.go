@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointFailover(t *testing.T) {
+	noRequestRetryDelay(t)
+	var downRequests, upRequests int
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downRequests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upRequests++
+		assert.Equal(t, "/delete", r.URL.Path)
+	}))
+	defer up.Close()
+	downUrl, _ := url.Parse(down.URL)
+	upUrl, _ := url.Parse(up.URL)
+	health := &EndpointHealth{}
+	cl := ServiceClient{
+		ReplicaServiceEndpoints: func() []*url.URL { return []*url.URL{downUrl, upUrl} },
+		EndpointHealth:          health,
+		HttpClient:              http.DefaultClient,
+	}
+
+	require.NoError(t, cl.DeleteUpload(Prefix("prefix"), "auth", false))
+	assert.Equal(t, 1, downRequests)
+	assert.Equal(t, 1, upRequests)
+	// The failed endpoint is passed over until its cooldown expires.
+	assert.Equal(t, []*url.URL{upUrl, downUrl}, cl.Endpoints())
+	require.NoError(t, cl.DeleteUpload(Prefix("prefix"), "auth", false))
+	assert.Equal(t, 1, downRequests)
+	assert.Equal(t, 2, upRequests)
+
+	stats := health.Stats()
+	require.Len(t, stats, 2)
+	for _, s := range stats {
+		switch s.Url {
+		case downUrl.String():
+			assert.EqualValues(t, 1, s.Failures)
+			assert.Equal(t, 1, s.ConsecutiveFailures)
+		case upUrl.String():
+			assert.EqualValues(t, 2, s.Successes)
+			assert.NotZero(t, s.Latency)
+		}
+	}
+}
+
+func TestEndpointFailoverNotForRejections(t *testing.T) {
+	var otherRequests int
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer rejecting.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherRequests++
+	}))
+	defer other.Close()
+	rejectingUrl, _ := url.Parse(rejecting.URL)
+	otherUrl, _ := url.Parse(other.URL)
+	cl := ServiceClient{
+		ReplicaServiceEndpoints: func() []*url.URL { return []*url.URL{rejectingUrl, otherUrl} },
+		EndpointHealth:          &EndpointHealth{},
+		HttpClient:              http.DefaultClient,
+	}
+	err := cl.DeleteUpload(Prefix("prefix"), "auth", false)
+	var serviceErr *Error
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, ErrorCategoryAuthFailure, serviceErr.Category)
+	assert.Zero(t, otherRequests)
+	// A rejection says nothing about the endpoint's health.
+	assert.Equal(t, []*url.URL{rejectingUrl, otherUrl}, cl.Endpoints())
+}
+
+func TestNonIdempotentRequestsRetryOnlyWhenUnsent(t *testing.T) {
+	assert.False(t, retryUnsent.allows(newStatusError(http.StatusServiceUnavailable, nil)))
+	assert.True(t, retryIdempotent.allows(newStatusError(http.StatusServiceUnavailable, nil)))
+	assert.False(t, retryNever.allows(newStatusError(http.StatusServiceUnavailable, nil)))
+
+	// Nothing listens on a closed server's address, so the dial fails.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	_, err := http.Get(srv.URL)
+	require.Error(t, err)
+	assert.True(t, retryUnsent.allows(newTransportError(err)))
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorCategory broadly classifies why a request to the Replica service failed.
+type ErrorCategory string
+
+const (
+	// The admin token or other credentials were rejected.
+	ErrorCategoryAuthFailure ErrorCategory = "auth_failure"
+	ErrorCategoryNotFound    ErrorCategory = "not_found"
+	// The upload exceeds what the service accepts.
+	ErrorCategoryPayloadTooLarge ErrorCategory = "payload_too_large"
+	ErrorCategoryRateLimited     ErrorCategory = "rate_limited"
+	// The service couldn't be reached, or is failing. Includes network errors.
+	ErrorCategoryUpstreamUnavailable ErrorCategory = "upstream_unavailable"
+	// The service didn't like the request for some other reason.
+	ErrorCategoryRejected ErrorCategory = "rejected"
+)
+
+// Error is returned by ServiceClient when a request to the service fails, either because the
+// request couldn't be made or the service responded with an unexpected status.
+type Error struct {
+	// Zero if there was no response.
+	StatusCode int
+	Category   ErrorCategory
+	// Whether the same request could succeed later.
+	Retryable bool
+	// The response body, if there was one.
+	Body []byte
+	// The transport error, if there was no response.
+	Err error
+}
+
+func (me *Error) Error() string {
+	if me.Err != nil {
+		return fmt.Sprintf("%s: %v", me.Category, me.Err)
+	}
+	return fmt.Sprintf("%s: got unexpected status code %v for response %q", me.Category, me.StatusCode, me.Body)
+}
+
+func (me *Error) Unwrap() error {
+	return me.Err
+}
+
+func newStatusError(statusCode int, body []byte) *Error {
+	e := &Error{
+		StatusCode: statusCode,
+		Body:       body,
+	}
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		e.Category = ErrorCategoryAuthFailure
+	case http.StatusNotFound, http.StatusGone:
+		e.Category = ErrorCategoryNotFound
+	case http.StatusRequestEntityTooLarge:
+		e.Category = ErrorCategoryPayloadTooLarge
+	case http.StatusTooManyRequests:
+		e.Category = ErrorCategoryRateLimited
+		e.Retryable = true
+	case http.StatusRequestTimeout:
+		e.Category = ErrorCategoryUpstreamUnavailable
+		e.Retryable = true
+	case http.StatusNotImplemented:
+		// This won't go away by trying again.
+		e.Category = ErrorCategoryRejected
+	default:
+		if statusCode/100 == 5 {
+			e.Category = ErrorCategoryUpstreamUnavailable
+			e.Retryable = true
+		} else {
+			e.Category = ErrorCategoryRejected
+		}
+	}
+	return e
+}
+
+// For when no response was received.
+func newTransportError(err error) *Error {
+	return &Error{
+		Category:  ErrorCategoryUpstreamUnavailable,
+		Retryable: true,
+		Err:       err,
+	}
+}
+
+// ResponseError classifies the outcome of a request to the service made outside of ServiceClient,
+// like when proxying. Returns nil for a 200 response. The body is left alone.
+func ResponseError(resp *http.Response, err error) error {
+	if err != nil {
+		return newTransportError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp.StatusCode, nil)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Returned by UploadOptions.Validate, wrapped with the specifics.
+var ErrInvalidUploadOptions = errors.New("invalid upload options")
+
+const (
+	MaxUploadTitleLength       = 200
+	MaxUploadDescriptionLength = 5000
+	MaxUploadTags              = 20
+	MaxUploadTagLength         = 50
+)
+
+// Licenses an upload can declare.
+var UploadLicenses = []string{
+	"all-rights-reserved",
+	"public-domain",
+	"cc0",
+	"cc-by",
+	"cc-by-sa",
+	"cc-by-nd",
+	"cc-by-nc",
+	"cc-by-nc-sa",
+	"cc-by-nc-nd",
+	"other",
+}
+
+// Categories an upload can be marked with, so search can filter on them.
+var UploadContentCategories = []string{
+	"news",
+	"education",
+	"documentary",
+	"entertainment",
+	"music",
+	"books",
+	"software",
+	// Content that shouldn't be shown without a warning.
+	"sensitive",
+	"adult",
+}
+
+// Loosely BCP 47: a primary language and optional subtags.
+var uploadLanguageRegexp = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{1,8})*$`)
+
+// Validate checks the options are something the service should accept. The returned error wraps
+// ErrInvalidUploadOptions.
+func (uo UploadOptions) Validate() error {
+	if err := checkUploadOptionText("title", uo.Title, MaxUploadTitleLength, false); err != nil {
+		return err
+	}
+	if err := checkUploadOptionText("description", uo.Description, MaxUploadDescriptionLength, true); err != nil {
+		return err
+	}
+	if len(uo.Tags) > MaxUploadTags {
+		return fmt.Errorf("%w: more than %v tags", ErrInvalidUploadOptions, MaxUploadTags)
+	}
+	for _, tag := range uo.Tags {
+		if tag == "" {
+			return fmt.Errorf("%w: empty tag", ErrInvalidUploadOptions)
+		}
+		if err := checkUploadOptionText("tag", tag, MaxUploadTagLength, false); err != nil {
+			return err
+		}
+	}
+	if uo.Language != "" && !uploadLanguageRegexp.MatchString(uo.Language) {
+		return fmt.Errorf("%w: bad language tag %q", ErrInvalidUploadOptions, uo.Language)
+	}
+	if uo.License != "" && !slices.Contains(UploadLicenses, uo.License) {
+		return fmt.Errorf("%w: unknown license %q", ErrInvalidUploadOptions, uo.License)
+	}
+	for _, c := range uo.ContentCategories {
+		if !slices.Contains(UploadContentCategories, c) {
+			return fmt.Errorf("%w: unknown content category %q", ErrInvalidUploadOptions, c)
+		}
+	}
+	return nil
+}
+
+func checkUploadOptionText(field, s string, maxLength int, allowNewlines bool) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("%w: %v is not valid UTF-8", ErrInvalidUploadOptions, field)
+	}
+	if n := utf8.RuneCountInString(s); n > maxLength {
+		return fmt.Errorf("%w: %v is %v characters, more than %v", ErrInvalidUploadOptions, field, n, maxLength)
+	}
+	for _, r := range s {
+		if allowNewlines && (r == '\n' || r == '\r' || r == '\t') {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %v contains control characters", ErrInvalidUploadOptions, field)
+		}
+	}
+	return nil
+}
+
+func cleanUploadOptionList(items []string) (ret []string) {
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item != "" && !slices.Contains(ret, item) {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadOptionsRoundTrip(t *testing.T) {
+	uo := UploadOptions{
+		Title:             "Title & such",
+		Description:       "Line one\nLine two",
+		Tags:              []string{"protest", "tehran"},
+		Language:          "fa-IR",
+		License:           "cc-by-sa",
+		ContentCategories: []string{"news", "sensitive"},
+	}
+	require.NoError(t, uo.Validate())
+	r := httptest.NewRequest("PUT", "/upload?"+uo.Encode(), nil)
+	assert.Equal(t, uo, NewUploadOptions(r))
+
+	v, err := url.ParseQuery("tag=+a+&tag=b&tag=a&tag=&category=news")
+	require.NoError(t, err)
+	var cleaned UploadOptions
+	cleaned.SetFromValues(v)
+	assert.Equal(t, UploadOptions{Tags: []string{"a", "b"}, ContentCategories: []string{"news"}}, cleaned)
+
+	// Only the given fields change.
+	uo.SetFromValues(url.Values{"license": {""}})
+	assert.Equal(t, "", uo.License)
+	assert.Equal(t, "fa-IR", uo.Language)
+}
+
+func TestUploadOptionsValidate(t *testing.T) {
+	for _, uo := range []UploadOptions{
+		{Title: strings.Repeat("x", MaxUploadTitleLength+1)},
+		{Title: "bell\a"},
+		{Tags: []string{strings.Repeat("x", MaxUploadTagLength+1)}},
+		{Tags: make([]string, MaxUploadTags+1)},
+		{Language: "english please"},
+		{License: "wtfpl"},
+		{ContentCategories: []string{"cats"}},
+	} {
+		assert.ErrorIs(t, uo.Validate(), ErrInvalidUploadOptions, "%#v", uo)
+	}
+	// Lengths are in characters, not bytes.
+	assert.NoError(t, UploadOptions{Title: strings.Repeat("ж", MaxUploadTitleLength)}.Validate())
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// Reads no faster than the limiter allows. Reads are cut to the limiter's burst, which must be
+// positive. Waiting stops when ctx is done.
+type rateLimitedReader struct {
+	ctx context.Context
+	l   *rate.Limiter
+	r   io.Reader
+}
+
+func (me rateLimitedReader) Read(b []byte) (n int, err error) {
+	if me.l.Limit() != rate.Inf && len(b) > me.l.Burst() {
+		b = b[:me.l.Burst()]
+	}
+	n, err = me.r.Read(b)
+	if n > 0 {
+		waitErr := me.l.WaitN(me.ctx, n)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+// Limits r with l, if there is one.
+func rateLimitReader(ctx context.Context, l *rate.Limiter, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return rateLimitedReader{ctx, l, r}
+}
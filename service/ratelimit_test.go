@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestUploadRateLimit(t *testing.T) {
+	var received int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received = len(b)
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	defer srv.Close()
+	limiter := rate.NewLimiter(1<<20, 64<<10)
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+		UploadRateLimiter:      limiter,
+	}
+	started := time.Now()
+	_, err := cl.Upload(bytes.NewReader(make([]byte, 512<<10)), "file", UploadOptions{})
+	require.Error(t, err)
+	assert.Equal(t, 512<<10, received)
+	// The first burst is free, and the rest is sent at the limit.
+	assert.GreaterOrEqual(t, time.Since(started), 400*time.Millisecond)
+
+	limiter.SetLimit(rate.Inf)
+	started = time.Now()
+	_, err = cl.Upload(bytes.NewReader(make([]byte, 512<<10)), "file", UploadOptions{})
+	require.Error(t, err)
+	assert.Less(t, time.Since(started), 400*time.Millisecond)
+}
+
+// A rate-limited upload stops waiting when its context is done.
+func TestUploadRateLimitCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	health := &EndpointHealth{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+		EndpointHealth:         health,
+		// The second read waits about 100s.
+		UploadRateLimiter: rate.NewLimiter(1<<10, 100<<10),
+	}.WithContext(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	_, err := cl.Upload(bytes.NewReader(make([]byte, 200<<10)), "file", UploadOptions{})
+	require.Error(t, err)
+	assert.Less(t, time.Since(started), 10*time.Second)
+	for _, stats := range health.Stats() {
+		assert.Zero(t, stats.Failures)
+	}
+}
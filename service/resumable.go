@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// Resumable uploads go through an upload session in replica-rust:
+//
+//	POST upload-session/<file name>?<upload options>  -> {"session_id": "..."}
+//	     (X-Upload-Content-Type is the content type of the assembled body, if it matters)
+//	GET  upload-session/<session id>                  -> {"parts": <count of parts received>}
+//	PUT  upload-session/<session id>/<part index>     (discards any parts at or after the index)
+//	POST upload-session/<session id>/complete         -> ServiceUploadOutput
+//
+// Services that don't know about sessions respond 404 (or 405/501) to the first request, and we
+// fall back to a single PUT of the whole body.
+
+const DefaultUploadPartSize = 8 << 20
+
+// Persisted after every acknowledged part.
+type resumableUploadState struct {
+	SessionId string `json:"session_id"`
+	PartSize  int64  `json:"part_size"`
+	// Hex SHA-256 of each part acknowledged by the service, in order. Used to check that resumed
+	// content matches what was already sent.
+	PartHashes []string `json:"part_hashes"`
+}
+
+type serviceUploadSession struct {
+	SessionId string `json:"session_id"`
+	Parts     int    `json:"parts"`
+}
+
+func (cl ServiceClient) uploadPartSize() int64 {
+	if cl.UploadPartSize > 0 {
+		return cl.UploadPartSize
+	}
+	return DefaultUploadPartSize
+}
+
+// The state file is keyed on everything that goes into creating the session. Content differences
+// are caught by the part hashes.
+func (cl ServiceClient) resumableUploadStatePath(contentType, fileName string, uploadOptions UploadOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d", contentType, fileName, uploadOptions.Encode(), cl.uploadPartSize())
+	return filepath.Join(cl.ResumableUploadsDir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+func loadResumableUploadState(path string) (state resumableUploadState, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &state)
+	return
+}
+
+func storeResumableUploadState(path string, state resumableUploadState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash doesn't leave a truncated state file behind.
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+var errUploadSessionsUnsupported = errors.New("service does not support upload sessions")
+
+// Splits the upload into parts, persisting progress to ResumableUploadsDir. If a previous attempt
+// with the same file name and options failed, parts the service already has are read from the
+// stream but not sent again.
+func (cl ServiceClient) uploadResumable(
+	read io.Reader,
+	contentType string,
+	fileName string,
+	uploadOptions UploadOptions,
+) (output UploadOutput, err error) {
+	statePath := cl.resumableUploadStatePath(contentType, fileName, uploadOptions)
+	state, err := loadResumableUploadState(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		// Not worth failing the upload over.
+		log.Errorf("loading resumable upload state from %q: %v", statePath, err)
+	}
+	acked := 0
+	if state.SessionId != "" {
+		var session serviceUploadSession
+		session, err = cl.getUploadSession(state.SessionId)
+		if err == nil {
+			acked = min(session.Parts, len(state.PartHashes))
+			log.Debugf("resuming upload session %q at part %v", state.SessionId, acked)
+		} else {
+			log.Debugf("can't resume upload session %q: %v", state.SessionId, err)
+			state = resumableUploadState{}
+		}
+	}
+	if state.SessionId == "" {
+		var session serviceUploadSession
+		session, err = cl.createUploadSession(contentType, fileName, uploadOptions)
+		if errors.Is(err, errUploadSessionsUnsupported) {
+			log.Debugf("falling back to single request upload: %v", err)
+			return cl.uploadSingle(read, contentType, fileName, uploadOptions)
+		}
+		if err != nil {
+			err = fmt.Errorf("creating upload session: %w", err)
+			return
+		}
+		state = resumableUploadState{
+			SessionId: session.SessionId,
+			PartSize:  cl.uploadPartSize(),
+		}
+	}
+	buf := make([]byte, state.PartSize)
+	var (
+		numParts int
+		lastPart []byte
+	)
+	for partIndex := 0; ; partIndex++ {
+		var n int
+		n, err = io.ReadFull(read, buf)
+		if err == io.EOF {
+			break
+		}
+		numParts++
+		if err != nil && err != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("reading part %v: %w", partIndex, err)
+			return
+		}
+		isLastPart := err == io.ErrUnexpectedEOF
+		part := buf[:n]
+		lastPart = part
+		partHash := sha256.Sum256(part)
+		partHashHex := hex.EncodeToString(partHash[:])
+		if partIndex < acked && state.PartHashes[partIndex] == partHashHex {
+			log.Tracef("skipping part %v already received by service", partIndex)
+		} else {
+			err = cl.putUploadPart(state.SessionId, partIndex, part)
+			if err != nil {
+				err = fmt.Errorf("uploading part %v: %w", partIndex, err)
+				return
+			}
+			cl.partSent(part)
+			// The service discards anything after a part it receives, so we do too.
+			state.PartHashes = append(state.PartHashes[:partIndex], partHashHex)
+			acked = partIndex + 1
+			if storeErr := storeResumableUploadState(statePath, state); storeErr != nil {
+				log.Errorf("storing resumable upload state: %v", storeErr)
+			}
+		}
+		if isLastPart {
+			break
+		}
+	}
+	if numParts < acked {
+		// The content is a prefix of what was sent before. Resending the final part makes the
+		// service drop everything after it.
+		if numParts == 0 {
+			os.Remove(statePath)
+			return cl.uploadResumable(read, contentType, fileName, uploadOptions)
+		}
+		err = cl.putUploadPart(state.SessionId, numParts-1, lastPart)
+		if err != nil {
+			err = fmt.Errorf("uploading part %v: %w", numParts-1, err)
+			return
+		}
+		cl.partSent(lastPart)
+	}
+	output, err = cl.completeUploadSession(state.SessionId)
+	if err != nil {
+		err = fmt.Errorf("completing upload session: %w", err)
+		return
+	}
+	os.Remove(statePath)
+	return
+}
+
+func uploadSessionUrl(endpoint *url.URL, elems ...string) *url.URL {
+	return endpoint.ResolveReference(&url.URL{
+		Path: path.Join(append([]string{"upload-session"}, elems...)...),
+	})
+}
+
+func (cl ServiceClient) createUploadSession(contentType, fileName string, uploadOptions UploadOptions) (session serviceUploadSession, err error) {
+	// Repeating this would leave an abandoned session behind.
+	respBody, err := cl.doWithRetries(retryUnsent, func(endpoint *url.URL) (*http.Request, error) {
+		u := uploadSessionUrl(endpoint, fileName)
+		u.RawQuery = uploadOptions.Encode()
+		req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("X-Upload-Content-Type", contentType)
+		}
+		return req, nil
+	})
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		switch serviceErr.StatusCode {
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			err = fmt.Errorf("%w: %v", errUploadSessionsUnsupported, err)
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(respBody, &session)
+	if err == nil && session.SessionId == "" {
+		err = errors.New("service returned empty session id")
+	}
+	return
+}
+
+func (cl ServiceClient) getUploadSession(sessionId string) (session serviceUploadSession, err error) {
+	respBody, err := cl.doWithRetries(retryIdempotent, func(endpoint *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, uploadSessionUrl(endpoint, sessionId).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(respBody, &session)
+	return
+}
+
+func (cl ServiceClient) putUploadPart(sessionId string, partIndex int, part []byte) error {
+	_, err := cl.doWithRetries(retryIdempotent, func(endpoint *url.URL) (*http.Request, error) {
+		return http.NewRequest(
+			http.MethodPut,
+			uploadSessionUrl(endpoint, sessionId, strconv.Itoa(partIndex)).String(),
+			bytes.NewReader(part),
+		)
+	})
+	return err
+}
+
+func (cl ServiceClient) partSent(part []byte) {
+	if cl.OnUploadContentSent != nil {
+		cl.OnUploadContentSent(int64(len(part)))
+	}
+}
+
+func (cl ServiceClient) completeUploadSession(sessionId string) (output UploadOutput, err error) {
+	// Completing a session again returns the same upload.
+	respBody, err := cl.doWithRetries(retryIdempotent, func(endpoint *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, uploadSessionUrl(endpoint, sessionId, "complete").String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json, text/plain, text/html;q=0")
+		return req, nil
+	})
+	if err != nil {
+		return
+	}
+	return parseServiceUploadOutput(respBody)
+}
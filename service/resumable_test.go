@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A stand-in for the replica-rust upload session endpoints.
+type fakeSessionService struct {
+	mu       sync.Mutex
+	sessions map[string][][]byte
+	// Count of PUTs received per part index.
+	partPuts map[int]int
+	// Fail puts of this part index while set.
+	failPart func(int) bool
+}
+
+func (me *fakeSessionService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload-session/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 1:
+		id := strconv.Itoa(len(me.sessions))
+		me.sessions[id] = nil
+		json.NewEncoder(w).Encode(serviceUploadSession{SessionId: id})
+	case r.Method == http.MethodGet && len(parts) == 1:
+		session, ok := me.sessions[parts[0]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(serviceUploadSession{SessionId: parts[0], Parts: len(session)})
+	case r.Method == http.MethodPut && len(parts) == 2:
+		index, _ := strconv.Atoi(parts[1])
+		me.partPuts[index]++
+		if me.failPart != nil && me.failPart(index) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		session := me.sessions[parts[0]]
+		if index > len(session) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		me.sessions[parts[0]] = append(session[:index], b)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "complete":
+		data := bytes.Join(me.sessions[parts[0]], nil)
+		info := metainfo.Info{Name: "file", PieceLength: testPieceLength, Length: int64(len(data))}
+		err := info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			panic(err)
+		}
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		mi.Comment = ExactSource(Prefix(mi.HashInfoBytes().HexString()))
+		json.NewEncoder(w).Encode(ServiceUploadOutput{
+			Link:       mi.Magnet(nil, &info).String() + "&xs=" + url.QueryEscape(mi.Comment),
+			Metainfo:   JsonBinaryString{bencode.MustMarshal(mi)},
+			AdminToken: "token",
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestResumableUploadAfterFailure(t *testing.T) {
+	noRequestRetryDelay(t)
+	fake := &fakeSessionService{
+		sessions: make(map[string][][]byte),
+		partPuts: make(map[int]int),
+	}
+	failing := true
+	fake.failPart = func(i int) bool { return failing && i == 3 }
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+		ResumableUploadsDir:    t.TempDir(),
+		UploadPartSize:         1000,
+	}
+	var sent int64
+	cl.OnUploadContentSent = func(n int64) { sent += n }
+	data := make([]byte, 4500)
+	rand.Read(data)
+
+	_, err := cl.Upload(bytes.NewReader(data), "file", UploadOptions{})
+	require.Error(t, err)
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1, 3: maxRequestAttempts}, fake.partPuts)
+	// Only acknowledged parts count.
+	assert.EqualValues(t, 3000, sent)
+
+	failing = false
+	output, err := cl.Upload(bytes.NewReader(data), "file", UploadOptions{})
+	require.NoError(t, err)
+	// Parts the service acknowledged before the failure are not sent again.
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1, 3: maxRequestAttempts + 1, 4: 1}, fake.partPuts)
+	assert.EqualValues(t, 4500, sent)
+	assert.EqualValues(t, len(data), output.Info.TotalLength())
+	assert.Equal(t, output.MetaInfo.HashInfoBytes().HexString(), output.Upload.String())
+	// Skipped parts are still hashed locally.
+	assert.True(t, output.Verified)
+}
+
+func TestResumableUploadChangedContent(t *testing.T) {
+	noRequestRetryDelay(t)
+	fake := &fakeSessionService{
+		sessions: make(map[string][][]byte),
+		partPuts: make(map[int]int),
+	}
+	fake.failPart = func(i int) bool { return i == 2 }
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+		ResumableUploadsDir:    t.TempDir(),
+		UploadPartSize:         1000,
+	}
+	first := bytes.Repeat([]byte("a"), 2500)
+	_, err := cl.Upload(bytes.NewReader(first), "file", UploadOptions{})
+	require.Error(t, err)
+
+	fake.failPart = nil
+	second := append(bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 1500)...)
+	output, err := cl.Upload(bytes.NewReader(second), "file", UploadOptions{})
+	require.NoError(t, err)
+	// The first part matched, the second didn't and replaced what the service had.
+	assert.Equal(t, 1, fake.partPuts[0])
+	assert.Equal(t, 2, fake.partPuts[1])
+	assert.EqualValues(t, len(second), output.Info.TotalLength())
+	assert.Equal(t, second, bytes.Join(fake.sessions["0"], nil))
+}
+
+func TestResumableUploadFallsBackWithoutSessions(t *testing.T) {
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.NotFound(w, r)
+			return
+		}
+		got, _ = io.ReadAll(r.Body)
+		info := metainfo.Info{Name: "file", PieceLength: testPieceLength, Length: int64(len(got))}
+		info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(got)), nil
+		})
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		json.NewEncoder(w).Encode(ServiceUploadOutput{
+			Link:     mi.Magnet(nil, &info).String() + "&xs=replica:prefix",
+			Metainfo: JsonBinaryString{bencode.MustMarshal(mi)},
+		})
+	}))
+	defer srv.Close()
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+		ResumableUploadsDir:    t.TempDir(),
+	}
+	var sent int64
+	cl.OnUploadContentSent = func(n int64) { sent += n }
+	_, err := cl.Upload(strings.NewReader("file content"), "file", UploadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "file content", string(got))
+	assert.EqualValues(t, len(got), sent)
+}
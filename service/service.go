@@ -1,37 +1,87 @@
 package service
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/getlantern/golog"
+	"golang.org/x/time/rate"
 )
 
+var log = golog.LoggerFor("replica.service")
+
 type UploadOptions struct {
-	Title       string
-	Description string
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Free-form labels for search.
+	Tags []string `json:"tags,omitempty"`
+	// A BCP 47 language tag for the content, like "en" or "fa-IR".
+	Language string `json:"language,omitempty"`
+	// One of UploadLicenses.
+	License string `json:"license,omitempty"`
+	// Any of UploadContentCategories.
+	ContentCategories []string `json:"contentCategories,omitempty"`
 }
 
 // NewUploadOptions returns a new UploadOptions initialized with values from the http.Request.
 func NewUploadOptions(r *http.Request) UploadOptions {
 	uo := UploadOptions{}
+	uo.SetFromValues(r.URL.Query())
+	return uo
+}
+
+// SetFromValues sets the fields present in v, in the form produced by Encode. Fields not in v are
+// left alone. List values are trimmed, and empty or repeated items are dropped.
+func (uo *UploadOptions) SetFromValues(v url.Values) {
+	if _, ok := v["title"]; ok {
+		uo.Title = v.Get("title")
+	}
+	if _, ok := v["description"]; ok {
+		uo.Description = v.Get("description")
+	}
+	if tags, ok := v["tag"]; ok {
+		uo.Tags = cleanUploadOptionList(tags)
+	}
+	if _, ok := v["language"]; ok {
+		uo.Language = strings.TrimSpace(v.Get("language"))
+	}
+	if _, ok := v["license"]; ok {
+		uo.License = strings.TrimSpace(v.Get("license"))
+	}
+	if categories, ok := v["category"]; ok {
+		uo.ContentCategories = cleanUploadOptionList(categories)
+	}
+}
 
-	q := r.URL.Query()
-	uo.Title = q.Get("title")
-	uo.Description = q.Get("description")
+// The form keys of the options, as produced by Encode.
+var UploadOptionFormKeys = []string{"title", "description", "tag", "language", "license", "category"}
 
-	return uo
+// UploadOptionKeys returns the keys of the upload options present in v, like the options a request
+// is changing.
+func UploadOptionKeys(v url.Values) (keys []string) {
+	for _, key := range UploadOptionFormKeys {
+		if _, ok := v[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return
 }
 
-func (uo *UploadOptions) Encode() string {
+func (uo *UploadOptions) values() url.Values {
 	v := url.Values{}
 
 	if uo.Title != "" {
@@ -42,41 +92,219 @@ func (uo *UploadOptions) Encode() string {
 		v.Add("description", uo.Description)
 	}
 
-	return v.Encode()
+	if len(uo.Tags) != 0 {
+		v["tag"] = uo.Tags
+	}
+
+	if uo.Language != "" {
+		v.Add("language", uo.Language)
+	}
+
+	if uo.License != "" {
+		v.Add("license", uo.License)
+	}
+
+	if len(uo.ContentCategories) != 0 {
+		v["category"] = uo.ContentCategories
+	}
+
+	return v
+}
+
+func (uo *UploadOptions) Encode() string {
+	return uo.values().Encode()
 }
 
 type ServiceClient struct {
 	// This should be a URL to handle uploads. The specifics are in replica-rust.
 	ReplicaServiceEndpoint func() *url.URL
 	HttpClient             *http.Client
+	// Equivalent replica-rust endpoints in order of preference. Requests fail over between them. If
+	// nil or empty, ReplicaServiceEndpoint is used.
+	ReplicaServiceEndpoints func() []*url.URL
+	// Shared between copies of the client to order endpoints by health. Optional.
+	EndpointHealth *EndpointHealth
+	// If set, uploads are sent in parts through an upload session, and progress is kept in this
+	// directory so a failed upload of the same content can resume from the last acknowledged part.
+	ResumableUploadsDir string
+	// The part size for resumable uploads. Defaults to DefaultUploadPartSize.
+	UploadPartSize int64
+	// Limits how fast upload content is sent, in bytes per second. Optional. This can be shared with
+	// anything else that should count against the same limit, and changed while in use.
+	UploadRateLimiter *rate.Limiter
+	// Called with the number of bytes of upload content as the service takes them: as the request
+	// body is sent for single request uploads, and as each part is acknowledged for resumable ones.
+	// Optional.
+	OnUploadContentSent func(n int64)
+	// The piece length the service hashes uploads with, so they can be verified as they're sent.
+	// Defaults to DefaultUploadPieceLength. Uploads hashed with another can't be fully verified.
+	UploadPieceLength int64
+	// Set with WithContext.
+	ctx context.Context
+}
+
+// WithContext returns a copy of the client whose requests, and waits on UploadRateLimiter, stop when
+// ctx is done.
+func (cl ServiceClient) WithContext(ctx context.Context) ServiceClient {
+	cl.ctx = ctx
+	return cl
+}
+
+func (cl ServiceClient) uploadPieceLength() int64 {
+	if cl.UploadPieceLength > 0 {
+		return cl.UploadPieceLength
+	}
+	return DefaultUploadPieceLength
+}
+
+func (cl ServiceClient) context() context.Context {
+	if cl.ctx == nil {
+		return context.Background()
+	}
+	return cl.ctx
 }
 
 func (cl ServiceClient) Upload(read io.Reader, fileName string, uploadOptions UploadOptions) (output UploadOutput, err error) {
-	req, err := http.NewRequest(http.MethodPut, serviceUploadUrl(cl.ReplicaServiceEndpoint, fileName).String(), read)
+	verifier := newUploadVerifier(cl.uploadPieceLength())
+	output, err = cl.upload(verifier.addFile([]string{fileName}, read), "", fileName, uploadOptions)
+	if err != nil {
+		return
+	}
+	err = verifier.verify(&output)
+	return
+}
+
+// A file in a multi-file upload.
+type MultiUploadFile struct {
+	// The path of the file within the upload, as it should appear in the torrent.
+	Path   []string
+	Reader io.Reader
+}
+
+// UploadFiles uploads several files as a single Replica object, which will be a multi-file torrent.
+// The files are sent to replica-rust as multipart/form-data, with the path of each file in the
+// filename of its part.
+func (cl ServiceClient) UploadFiles(name string, files []MultiUploadFile, uploadOptions UploadOptions) (output UploadOutput, err error) {
+	pr, pw := io.Pipe()
+	// Unblocks the writer if the upload fails before consuming everything.
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	// A boundary that is stable for the same files lets resumable uploads pick up where they left
+	// off.
+	err = mw.SetBoundary(multiUploadBoundary(name, files))
+	if err != nil {
+		err = fmt.Errorf("setting multipart boundary: %w", err)
+		return
+	}
+	verifier := newUploadVerifier(cl.uploadPieceLength())
+	verifiedFiles := make([]MultiUploadFile, 0, len(files))
+	for _, f := range files {
+		verifiedFiles = append(verifiedFiles, MultiUploadFile{
+			Path:   f.Path,
+			Reader: verifier.addFile(f.Path, f.Reader),
+		})
+	}
+	go func() {
+		pw.CloseWithError(writeMultiUploadBody(mw, verifiedFiles))
+	}()
+	output, err = cl.upload(pr, mw.FormDataContentType(), name, uploadOptions)
 	if err != nil {
-		err = fmt.Errorf("creating put request: %w", err)
 		return
 	}
+	err = verifier.verify(&output)
+	return
+}
+
+func multiUploadBoundary(name string, files []MultiUploadFile) string {
+	h := sha256.New()
+	io.WriteString(h, name)
+	for _, f := range files {
+		fmt.Fprintf(h, "\x00%q", f.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:60]
+}
+
+func writeMultiUploadBody(mw *multipart.Writer, files []MultiUploadFile) error {
+	for _, f := range files {
+		pw, err := mw.CreateFormFile("file", path.Join(f.Path...))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pw, f.Reader)
+		if err != nil {
+			return fmt.Errorf("copying %q: %w", f.Path, err)
+		}
+	}
+	return mw.Close()
+}
 
-	req.URL.RawQuery = uploadOptions.Encode()
+// contentType is for the body, and is left unset if empty.
+func (cl ServiceClient) upload(read io.Reader, contentType, fileName string, uploadOptions UploadOptions) (output UploadOutput, err error) {
+	read = rateLimitReader(cl.context(), cl.UploadRateLimiter, read)
+	if cl.ResumableUploadsDir != "" {
+		return cl.uploadResumable(read, contentType, fileName, uploadOptions)
+	}
+	return cl.uploadSingle(read, contentType, fileName, uploadOptions)
+}
+
+// Uploads the entire body in a single request.
+func (cl ServiceClient) uploadSingle(read io.Reader, contentType, fileName string, uploadOptions UploadOptions) (output UploadOutput, err error) {
+	// The body is consumed by the first attempt.
+	respBodyBytes, err := cl.doWithRetries(retryNever, func(endpoint *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, serviceUploadUrl(endpoint, fileName).String(), cl.uploadContentSentReader(read))
+		if err != nil {
+			return nil, fmt.Errorf("creating put request: %w", err)
+		}
+
+		req.URL.RawQuery = uploadOptions.Encode()
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		req.Header.Set("Accept", "application/json, text/plain, text/html;q=0")
+		return req, nil
+	})
+	if err != nil {
+		return
+	}
+	return parseServiceUploadOutput(respBodyBytes)
+}
 
-	req.Header.Set("Accept", "application/json, text/plain, text/html;q=0")
+// Reports what's read from r by the HTTP client as sent.
+func (cl ServiceClient) uploadContentSentReader(r io.Reader) io.Reader {
+	if cl.OnUploadContentSent == nil {
+		return r
+	}
+	return readerFunc(func(b []byte) (n int, err error) {
+		n, err = r.Read(b)
+		if n > 0 {
+			cl.OnUploadContentSent(int64(n))
+		}
+		return
+	})
+}
+
+// Does a request to the service, returning the body of a 200 response. Otherwise the error is an
+// *Error.
+func (cl ServiceClient) doRequest(req *http.Request) (respBody []byte, err error) {
 	resp, err := cl.HttpClient.Do(req)
 	if err != nil {
-		err = fmt.Errorf("doing request: %w", err)
+		err = newTransportError(fmt.Errorf("doing request: %w", err))
 		return
 	}
 	defer resp.Body.Close()
-	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	respBody, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		err = fmt.Errorf("reading all response body bytes: %w", err)
+		err = newTransportError(fmt.Errorf("reading all response body bytes: %w", err))
 		return
 	}
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("got unexpected status code %v for response %q",
-			resp.StatusCode, respBodyBytes)
-		return
+		err = newStatusError(resp.StatusCode, respBody)
 	}
+	return
+}
+
+func parseServiceUploadOutput(respBodyBytes []byte) (output UploadOutput, err error) {
 	var serviceOutput ServiceUploadOutput
 	err = json.Unmarshal(respBodyBytes, &serviceOutput)
 	if err != nil {
@@ -130,18 +358,47 @@ func (cl ServiceClient) DeleteUpload(prefix Prefix, auth string, haveMetainfo bo
 		// We only use this field if we need to, to prevent detection and for backward compatibility.
 		data["have_metainfo"] = []string{"true"}
 	}
-	resp, err := cl.HttpClient.PostForm(
-		serviceDeleteUrl(cl.ReplicaServiceEndpoint).String(),
-		data,
-	)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected response: %q", resp.Status)
+	// Deleting an upload that's already gone is harmless.
+	_, err := cl.doWithRetries(retryIdempotent, func(endpoint *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			serviceDeleteUrl(endpoint).String(),
+			strings.NewReader(data.Encode()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	return err
+}
+
+// UpdateUpload replaces the options of an upload with uploadOptions. Options that are empty are
+// cleared. auth is the admin token returned when the upload was made.
+func (cl ServiceClient) UpdateUpload(prefix Prefix, auth string, uploadOptions UploadOptions) error {
+	data := uploadOptions.values()
+	for _, key := range UploadOptionFormKeys {
+		if _, ok := data[key]; !ok {
+			// Sent empty to clear it, whether it's a list or not.
+			data.Set(key, "")
+		}
 	}
-	return nil
+	data.Set("prefix", prefix.PrefixString())
+	data.Set("auth", auth)
+	_, err := cl.doWithRetries(retryIdempotent, func(endpoint *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			serviceUpdateUrl(endpoint).String(),
+			strings.NewReader(data.Encode()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	return err
 }
 
 // This exists for anything that doesn't have configuration but expects to connect to an arbitrary
@@ -195,10 +452,14 @@ var (
 )
 
 // Completes the upload endpoint URL with the file-name, per the replica-rust upload endpoint API.
-func serviceUploadUrl(base func() *url.URL, fileName string) *url.URL {
-	return base().ResolveReference(&url.URL{Path: path.Join("upload", fileName)})
+func serviceUploadUrl(base *url.URL, fileName string) *url.URL {
+	return base.ResolveReference(&url.URL{Path: path.Join("upload", fileName)})
+}
+
+func serviceDeleteUrl(base *url.URL) *url.URL {
+	return base.ResolveReference(&url.URL{Path: "delete"})
 }
 
-func serviceDeleteUrl(base func() *url.URL) *url.URL {
-	return base().ResolveReference(&url.URL{Path: "delete"})
+func serviceUpdateUrl(base *url.URL) *url.URL {
+	return base.ResolveReference(&url.URL{Path: "update"})
 }
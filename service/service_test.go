@@ -1,7 +1,12 @@
 package service
 
 import (
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,7 +21,7 @@ func TestAppendFileNameUploadUrl(t *testing.T) {
 	}
 	assert.Equal(t,
 		"https://some.service/upload/lmao",
-		serviceUploadUrl(fetchBaseUrlFunc, "lmao").String())
+		serviceUploadUrl(fetchBaseUrlFunc(), "lmao").String())
 	// There's no neat way to handle '/' in the file name, except maybe to
 	// accept a variable number of path segments in the handler in the upload
 	// service or do the URL path encoding manually.  But also having directory
@@ -25,13 +30,121 @@ func TestAppendFileNameUploadUrl(t *testing.T) {
 	// implementation in replica-rust.
 	assert.Equal(t,
 		"https://some.service/upload/hello/world",
-		serviceUploadUrl(fetchBaseUrlFunc, "hello/world").String())
+		serviceUploadUrl(fetchBaseUrlFunc(), "hello/world").String())
 
 	// Check that non-ASCII file names are encoded for upload, and decode back in the same manner
 	// that replica-rust works. https://github.com/getlantern/lantern-internal/issues/5401
-	cyrillicUploadUrl := serviceUploadUrl(fetchBaseUrlFunc, "rf200_now-Подписаться__Бот_для_поиска_своих__Резервный_канал.mov")
+	cyrillicUploadUrl := serviceUploadUrl(fetchBaseUrlFunc(), "rf200_now-Подписаться__Бот_для_поиска_своих__Резервный_канал.mov")
 	assert.Equal(t,
 		"https://some.service/upload/rf200_now-%D0%9F%D0%BE%D0%B4%D0%BF%D0%B8%D1%81%D0%B0%D1%82%D1%8C%D1%81%D1%8F__%D0%91%D0%BE%D1%82_%D0%B4%D0%BB%D1%8F_%D0%BF%D0%BE%D0%B8%D1%81%D0%BA%D0%B0_%D1%81%D0%B2%D0%BE%D0%B8%D1%85__%D0%A0%D0%B5%D0%B7%D0%B5%D1%80%D0%B2%D0%BD%D1%8B%D0%B9_%D0%BA%D0%B0%D0%BD%D0%B0%D0%BB.mov",
 		cyrillicUploadUrl.String())
 	assert.Equal(t, "/upload/rf200_now-Подписаться__Бот_для_поиска_своих__Резервный_канал.mov", cyrillicUploadUrl.Path)
 }
+
+func TestUploadFilesMultipartBody(t *testing.T) {
+	type part struct {
+		fileName string
+		content  string
+	}
+	var (
+		gotParts []part
+		gotPath  string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		mr, err := r.MultipartReader()
+		require.NoError(t, err)
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(p)
+			require.NoError(t, err)
+			// Part.FileName strips directories.
+			_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+			require.NoError(t, err)
+			gotParts = append(gotParts, part{params["filename"], string(b)})
+		}
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	defer srv.Close()
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+	}
+	_, err := cl.UploadFiles("show", []MultiUploadFile{
+		{Path: []string{"video.mp4"}, Reader: strings.NewReader("video")},
+		{Path: []string{"subs", "en.srt"}, Reader: strings.NewReader("subtitles")},
+	}, UploadOptions{})
+	require.Error(t, err)
+	assert.Equal(t, "/upload/show", gotPath)
+	assert.Equal(t, []part{{"video.mp4", "video"}, {"subs/en.srt", "subtitles"}}, gotParts)
+}
+
+// Retries requests immediately for the rest of the test.
+func noRequestRetryDelay(t *testing.T) {
+	old := requestRetryDelay
+	requestRetryDelay = 0
+	t.Cleanup(func() { requestRetryDelay = old })
+}
+
+func TestServiceErrorClassification(t *testing.T) {
+	noRequestRetryDelay(t)
+	status := http.StatusForbidden
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", status)
+	}))
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+	}
+	var serviceErr *Error
+	err := cl.DeleteUpload("prefix", "auth", false)
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, ErrorCategoryAuthFailure, serviceErr.Category)
+	assert.Equal(t, http.StatusForbidden, serviceErr.StatusCode)
+	assert.False(t, serviceErr.Retryable)
+
+	status = http.StatusTooManyRequests
+	err = cl.DeleteUpload("prefix", "auth", false)
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, ErrorCategoryRateLimited, serviceErr.Category)
+	assert.True(t, serviceErr.Retryable)
+
+	srv.Close()
+	err = cl.DeleteUpload("prefix", "auth", false)
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, ErrorCategoryUpstreamUnavailable, serviceErr.Category)
+	assert.Zero(t, serviceErr.StatusCode)
+	assert.True(t, serviceErr.Retryable)
+}
+
+func TestUpdateUpload(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/update", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		got = r.PostForm
+	}))
+	defer srv.Close()
+	cl := ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+	}
+	uo := UploadOptions{Title: "new title", Description: "unchanged", Tags: []string{"a", "b"}}
+	err := cl.UpdateUpload("prefix", "auth", uo)
+	require.NoError(t, err)
+	// Every option is sent, and empty ones are sent to clear them.
+	assert.Equal(t, url.Values{
+		"prefix":      {"prefix"},
+		"auth":        {"auth"},
+		"title":       {"new title"},
+		"description": {"unchanged"},
+		"tag":         {"a", "b"},
+		"language":    {""},
+		"license":     {""},
+		"category":    {""},
+	}, got)
+}
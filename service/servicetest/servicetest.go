@@ -0,0 +1,531 @@
+// Package servicetest runs an in-process stand-in for replica-rust, so tests don't depend on a live
+// Replica service. Uploads are kept in memory, and served from a bucket layout like the real one so
+// they can be fetched by metainfo and webseed URLs.
+package servicetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+
+	"github.com/getlantern/replica"
+	"github.com/getlantern/replica/service"
+)
+
+// The piece length of the infos the server creates.
+const pieceLength = service.DefaultUploadPieceLength
+
+// FailureHook is called before the server handles each request. Returning a non-zero status code
+// fails the request with it instead. DropConnection closes the connection without a response.
+type FailureHook func(r *http.Request) (statusCode int)
+
+// Returned by a FailureHook to make the request fail without reaching the service.
+const DropConnection = -1
+
+// FailRequests returns a FailureHook that fails the next times requests whose path starts with
+// pathPrefix with statusCode. If times is zero or less, every matching request fails.
+func FailRequests(pathPrefix string, statusCode int, times int) FailureHook {
+	var (
+		mu     sync.Mutex
+		failed int
+	)
+	return func(r *http.Request) int {
+		if !strings.HasPrefix(r.URL.Path, pathPrefix) {
+			return 0
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if times > 0 && failed >= times {
+			return 0
+		}
+		failed++
+		return statusCode
+	}
+}
+
+// An upload held by the server.
+type Object struct {
+	Prefix   service.Prefix
+	InfoHash metainfo.Hash
+	// The name given with the upload.
+	Name       string
+	Link       string
+	AdminToken string
+	Options    service.UploadOptions
+	Info       metainfo.Info
+	// The bencoded metainfo, as served from the bucket.
+	Metainfo []byte
+	// Content of each file, in the same order as the info files.
+	Data         [][]byte
+	LastModified time.Time
+}
+
+type uploadSession struct {
+	name        string
+	contentType string
+	options     service.UploadOptions
+	parts       [][]byte
+	// Set once the session is completed, and returned for any further completions.
+	output *service.ServiceUploadOutput
+}
+
+// Server implements the replica-rust endpoints used by this module. Close it when done.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	objects     map[service.Prefix]*Object
+	sessions    map[string]*uploadSession
+	failureHook FailureHook
+}
+
+func NewServer() *Server {
+	me := &Server{
+		objects:  make(map[service.Prefix]*Object),
+		sessions: make(map[string]*uploadSession),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /upload/{name...}", me.handleUpload)
+	mux.HandleFunc("POST /upload-session/{name...}", me.handleCreateSession)
+	mux.HandleFunc("GET /upload-session/{id}", me.handleGetSession)
+	mux.HandleFunc("PUT /upload-session/{id}/{index}", me.handlePutPart)
+	mux.HandleFunc("POST /upload-session/{id}/complete", me.handleCompleteSession)
+	mux.HandleFunc("POST /delete", me.handleDelete)
+	mux.HandleFunc("POST /update", me.handleUpdate)
+	// The search proxy sends queries to the root of the endpoint.
+	mux.HandleFunc("GET /{$}", me.handleSearch)
+	mux.HandleFunc("GET /search", me.handleSearch)
+	mux.HandleFunc("GET /bucket/{prefix}/torrent", me.handleBucketMetainfo)
+	mux.HandleFunc("GET /bucket/{prefix}/data/{path...}", me.handleBucketData)
+	me.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		me.mu.Lock()
+		hook := me.failureHook
+		me.mu.Unlock()
+		if hook != nil {
+			switch statusCode := hook(r); statusCode {
+			case 0:
+			case DropConnection:
+				dropConnection(w)
+				return
+			default:
+				http.Error(w, "injected failure", statusCode)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return me
+}
+
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+// Replaces the failure hook. Nil stops failing requests.
+func (me *Server) SetFailureHook(hook FailureHook) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.failureHook = hook
+}
+
+// The URL to use as the replica-rust endpoint.
+func (me *Server) Endpoint() *url.URL {
+	u, err := url.Parse(me.URL)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// A client for the server.
+func (me *Server) ServiceClient() service.ServiceClient {
+	return service.ServiceClient{
+		ReplicaServiceEndpoint: me.Endpoint,
+		HttpClient:             me.Client(),
+	}
+}
+
+// The webseed base URL for the bucket, as in the replica options. Metainfos are at
+// <base><prefix>/torrent, and data under <base><prefix>/data/.
+func (me *Server) WebseedBaseUrl() string {
+	return me.URL + "/bucket/"
+}
+
+func (me *Server) MetainfoUrl(prefix service.Prefix) string {
+	return me.WebseedBaseUrl() + prefix.PrefixString() + "/torrent"
+}
+
+func (me *Server) WebseedUrl(prefix service.Prefix) string {
+	return me.WebseedBaseUrl() + prefix.PrefixString() + "/data/"
+}
+
+// Returns a copy of the object with the prefix, if it exists.
+func (me *Server) Object(prefix service.Prefix) (Object, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	obj, ok := me.objects[prefix]
+	if !ok {
+		return Object{}, false
+	}
+	return *obj, true
+}
+
+// Copies of all the objects, ordered by prefix.
+func (me *Server) Objects() (ret []Object) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, obj := range me.objects {
+		ret = append(ret, *obj)
+	}
+	slices.SortFunc(ret, func(a, b Object) int {
+		return strings.Compare(a.Prefix.PrefixString(), b.Prefix.PrefixString())
+	})
+	return
+}
+
+func uploadOptions(r *http.Request) service.UploadOptions {
+	var uo service.UploadOptions
+	uo.SetFromValues(r.URL.Query())
+	return uo
+}
+
+func (me *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output, err := me.putObject(r.PathValue("name"), r.Header.Get("Content-Type"), body, uploadOptions(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, output)
+}
+
+// Stores an object from an upload body.
+func (me *Server) putObject(
+	name, contentType string,
+	body []byte,
+	uo service.UploadOptions,
+) (output service.ServiceUploadOutput, err error) {
+	var (
+		files []service.UploadedFile
+		data  [][]byte
+	)
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "multipart/form-data" {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			var p *multipart.Part
+			p, err = mr.NextPart()
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			if err != nil {
+				return
+			}
+			// Part.FileName strips directories.
+			_, dispParams, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+			var b []byte
+			b, err = io.ReadAll(p)
+			if err != nil {
+				return
+			}
+			files = append(files, service.UploadedFile{
+				Path:   strings.Split(dispParams["filename"], "/"),
+				Length: int64(len(b)),
+			})
+			data = append(data, b)
+		}
+	} else {
+		files = []service.UploadedFile{{Path: []string{name}, Length: int64(len(body))}}
+		data = [][]byte{body}
+	}
+	hasher := service.NewPieceHasher(pieceLength)
+	for _, b := range data {
+		hasher.Write(b)
+	}
+	// Like replica-rust, each upload gets a new prefix, and the files always go in a directory named
+	// for it, even if there's only one.
+	prefix := service.NewUuidPrefix()
+	info := metainfo.Info{
+		Name:        prefix.PrefixString(),
+		PieceLength: hasher.PieceLength(),
+		Pieces:      hasher.Pieces(),
+	}
+	for _, f := range files {
+		info.Files = append(info.Files, metainfo.FileInfo{Path: f.Path, Length: f.Length})
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return
+	}
+	mi := metainfo.MetaInfo{
+		InfoBytes:    infoBytes,
+		CreationDate: time.Now().Unix(),
+	}
+	ih := mi.HashInfoBytes()
+	mi.Comment = service.ExactSource(prefix)
+	obj := &Object{
+		Prefix:       prefix,
+		InfoHash:     ih,
+		Name:         name,
+		AdminToken:   randomHex(),
+		Options:      uo,
+		Info:         info,
+		Metainfo:     bencode.MustMarshal(mi),
+		Data:         data,
+		LastModified: time.Now(),
+	}
+	if len(data) == 1 {
+		obj.Link = replica.CreateLink(ih, prefix, []string{name})
+	} else {
+		obj.Link = replica.CreateTorrentLink(ih, prefix, name)
+	}
+	me.mu.Lock()
+	me.objects[prefix] = obj
+	me.mu.Unlock()
+	output = service.ServiceUploadOutput{
+		Link:       obj.Link,
+		Metainfo:   service.JsonBinaryString{Bytes: obj.Metainfo},
+		AdminToken: obj.AdminToken,
+	}
+	return
+}
+
+func randomHex() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (me *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	id := randomHex()
+	me.mu.Lock()
+	me.sessions[id] = &uploadSession{
+		name:        r.PathValue("name"),
+		contentType: r.Header.Get("X-Upload-Content-Type"),
+		options:     uploadOptions(r),
+	}
+	me.mu.Unlock()
+	writeJson(w, map[string]any{"session_id": id})
+}
+
+func (me *Server) session(w http.ResponseWriter, r *http.Request) *uploadSession {
+	session, ok := me.sessions[r.PathValue("id")]
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return session
+}
+
+func (me *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	session := me.session(w, r)
+	if session == nil {
+		return
+	}
+	writeJson(w, map[string]any{
+		"session_id": r.PathValue("id"),
+		"parts":      len(session.parts),
+	})
+}
+
+func (me *Server) handlePutPart(w http.ResponseWriter, r *http.Request) {
+	part, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	session := me.session(w, r)
+	if session == nil {
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index > len(session.parts) {
+		http.Error(w, "bad part index", http.StatusBadRequest)
+		return
+	}
+	// Anything at or after the part is discarded.
+	session.parts = append(session.parts[:index], part)
+}
+
+func (me *Server) handleCompleteSession(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	session := me.session(w, r)
+	if session == nil {
+		me.mu.Unlock()
+		return
+	}
+	if session.output != nil {
+		me.mu.Unlock()
+		writeJson(w, session.output)
+		return
+	}
+	body := bytes.Join(session.parts, nil)
+	me.mu.Unlock()
+	output, err := me.putObject(session.name, session.contentType, body, session.options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	me.mu.Lock()
+	session.output = &output
+	me.mu.Unlock()
+	writeJson(w, output)
+}
+
+// Returns the object for the prefix and auth in the form, or writes the error response.
+func (me *Server) authorizedObject(w http.ResponseWriter, r *http.Request) *Object {
+	obj, ok := me.objects[service.Prefix(r.PostFormValue("prefix"))]
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	if r.PostFormValue("auth") != obj.AdminToken {
+		http.Error(w, "bad auth", http.StatusForbidden)
+		return nil
+	}
+	return obj
+}
+
+func (me *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	obj := me.authorizedObject(w, r)
+	if obj == nil {
+		return
+	}
+	delete(me.objects, obj.Prefix)
+}
+
+func (me *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	obj := me.authorizedObject(w, r)
+	if obj == nil {
+		return
+	}
+	// Options that aren't sent are left alone.
+	obj.Options.SetFromValues(r.PostForm)
+}
+
+// A search result, in the shape of SearchResultItem in replica-search.
+type SearchResult struct {
+	Link         string    `json:"replicaLink"`
+	FileSize     int64     `json:"fileSize"`
+	MimeTypes    []string  `json:"mimeTypes"`
+	LastModified time.Time `json:"lastModified"`
+	DisplayName  string    `json:"displayName"`
+}
+
+// Matches objects with the search term in their name, title, description or tags. An empty term
+// matches everything.
+func (me *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	term := strings.ToLower(r.URL.Query().Get("s"))
+	results := []SearchResult{}
+	for _, obj := range me.Objects() {
+		text := strings.ToLower(strings.Join(append(
+			[]string{obj.Name, obj.Options.Title, obj.Options.Description},
+			obj.Options.Tags...,
+		), "\n"))
+		if !strings.Contains(text, term) {
+			continue
+		}
+		result := SearchResult{
+			Link:         obj.Link,
+			FileSize:     obj.Info.TotalLength(),
+			MimeTypes:    []string{},
+			LastModified: obj.LastModified,
+			DisplayName:  obj.Name,
+		}
+		for _, fi := range obj.Info.UpvertedFiles() {
+			filePath := fi.BestPath()
+			if len(filePath) == 0 {
+				filePath = []string{obj.Info.Name}
+			}
+			mimeType := mime.TypeByExtension(path.Ext(filePath[len(filePath)-1]))
+			if !slices.Contains(result.MimeTypes, mimeType) {
+				result.MimeTypes = append(result.MimeTypes, mimeType)
+			}
+		}
+		results = append(results, result)
+	}
+	writeJson(w, results)
+}
+
+// Objects are in the bucket by both prefix and infohash, since clients only have the infohash for
+// torrents they didn't upload.
+func (me *Server) bucketObject(w http.ResponseWriter, r *http.Request) (Object, bool) {
+	key := r.PathValue("prefix")
+	obj, ok := me.Object(service.Prefix(key))
+	if !ok {
+		for _, o := range me.Objects() {
+			if o.InfoHash.HexString() == key {
+				obj, ok = o, true
+				break
+			}
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return obj, ok
+}
+
+func (me *Server) handleBucketMetainfo(w http.ResponseWriter, r *http.Request) {
+	obj, ok := me.bucketObject(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Write(obj.Metainfo)
+}
+
+// Serves files the way webseeds request them: <info name>/<file path>, or just <info name> for
+// single-file infos.
+func (me *Server) handleBucketData(w http.ResponseWriter, r *http.Request) {
+	obj, ok := me.bucketObject(w, r)
+	if !ok {
+		return
+	}
+	want := r.PathValue("path")
+	for i, fi := range obj.Info.UpvertedFiles() {
+		filePath := path.Join(append([]string{obj.Info.Name}, fi.BestPath()...)...)
+		if filePath == want {
+			http.ServeContent(w, r, path.Base(filePath), obj.LastModified, bytes.NewReader(obj.Data[i]))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
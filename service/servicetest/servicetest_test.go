@@ -0,0 +1,120 @@
+package servicetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/replica/service"
+)
+
+func get(t *testing.T, srv *Server, url_ string) (int, []byte) {
+	resp, err := srv.Client().Get(url_)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, b
+}
+
+func TestUploadSearchAndDelete(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	cl := srv.ServiceClient()
+
+	output, err := cl.Upload(strings.NewReader("file content"), "file.txt", service.UploadOptions{Title: "Hello"})
+	require.NoError(t, err)
+	assert.True(t, output.Verified)
+	prefix := output.Upload.Prefix
+	obj, ok := srv.Object(prefix)
+	require.True(t, ok)
+	assert.Equal(t, *output.AuthToken, obj.AdminToken)
+	assert.Equal(t, "Hello", obj.Options.Title)
+
+	status, b := get(t, srv, srv.MetainfoUrl(prefix))
+	require.Equal(t, http.StatusOK, status)
+	var mi metainfo.MetaInfo
+	require.NoError(t, bencode.Unmarshal(b, &mi))
+	assert.Equal(t, obj.InfoHash, mi.HashInfoBytes())
+	assert.Equal(t, service.ExactSource(prefix), mi.Comment)
+	// The file is in a directory named for the prefix.
+	info, err := mi.UnmarshalInfo()
+	require.NoError(t, err)
+	assert.Equal(t, prefix.PrefixString(), info.Name)
+	assert.Equal(t, []metainfo.FileInfo{{Path: []string{"file.txt"}, Length: 12}}, info.Files)
+	// The bucket has it by infohash too.
+	for _, key := range []service.Prefix{prefix, service.Prefix(obj.InfoHash.HexString())} {
+		status, b = get(t, srv, srv.WebseedUrl(key)+prefix.PrefixString()+"/file.txt")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "file content", string(b))
+	}
+
+	status, b = get(t, srv, srv.URL+"/?"+url.Values{"s": {"hello"}}.Encode())
+	require.Equal(t, http.StatusOK, status)
+	var results []SearchResult
+	require.NoError(t, json.Unmarshal(b, &results))
+	require.Len(t, results, 1)
+	assert.Equal(t, *output.Link, results[0].Link)
+	assert.Equal(t, []string{"text/plain; charset=utf-8"}, results[0].MimeTypes)
+
+	require.NoError(t, cl.UpdateUpload(prefix, *output.AuthToken, service.UploadOptions{Tags: []string{"tag"}}))
+	obj, _ = srv.Object(prefix)
+	assert.Equal(t, service.UploadOptions{Tags: []string{"tag"}}, obj.Options)
+
+	var serviceErr *service.Error
+	require.ErrorAs(t, cl.DeleteUpload(prefix, "wrong", false), &serviceErr)
+	assert.Equal(t, service.ErrorCategoryAuthFailure, serviceErr.Category)
+	require.NoError(t, cl.DeleteUpload(prefix, *output.AuthToken, false))
+	assert.Empty(t, srv.Objects())
+	status, _ = get(t, srv, srv.MetainfoUrl(prefix))
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMultiFileResumableUpload(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	cl := srv.ServiceClient()
+	cl.ResumableUploadsDir = t.TempDir()
+	cl.UploadPartSize = 100
+	video := strings.Repeat("v", 250)
+
+	// Fails the first part, and then the upload is retried from the start.
+	srv.SetFailureHook(FailRequests("/upload-session/", http.StatusForbidden, 1))
+	_, err := cl.UploadFiles("show", []service.MultiUploadFile{
+		{Path: []string{"video.mp4"}, Reader: strings.NewReader(video)},
+	}, service.UploadOptions{})
+	require.Error(t, err)
+	assert.Empty(t, srv.Objects())
+
+	output, err := cl.UploadFiles("show", []service.MultiUploadFile{
+		{Path: []string{"video.mp4"}, Reader: strings.NewReader(video)},
+		{Path: []string{"subs", "en.srt"}, Reader: strings.NewReader("subtitles")},
+	}, service.UploadOptions{})
+	require.NoError(t, err)
+	assert.True(t, output.Verified)
+	prefix := output.Upload.Prefix.PrefixString()
+	status, b := get(t, srv, srv.WebseedUrl(output.Upload.Prefix)+prefix+"/subs/en.srt")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "subtitles", string(b))
+}
+
+func TestDropConnection(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SetFailureHook(func(r *http.Request) int { return DropConnection })
+	_, err := srv.ServiceClient().Upload(strings.NewReader("data"), "file", service.UploadOptions{})
+	var serviceErr *service.Error
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, service.ErrorCategoryUpstreamUnavailable, serviceErr.Category)
+	srv.SetFailureHook(nil)
+	_, err = srv.ServiceClient().Upload(strings.NewReader("data"), "file", service.UploadOptions{})
+	require.NoError(t, err)
+}
@@ -100,9 +100,6 @@ func (me *UploadMetainfo) FromTorrentMetainfo(mi *metainfo.MetaInfo, fileName st
 	if err != nil {
 		return fmt.Errorf("unmarshalling info: %w", err)
 	}
-	if len(info.UpvertedFiles()) != 1 {
-		return errors.New("expected single file")
-	}
 	*me = UploadMetainfo{
 		MetaInfo: mi,
 		Info:     info,
@@ -113,8 +110,26 @@ func (me *UploadMetainfo) FromTorrentMetainfo(mi *metainfo.MetaInfo, fileName st
 	return nil
 }
 
+// The path of the first file in the upload. For single file uploads, this is the only file.
 func (me UploadMetainfo) FilePath() []string {
-	return me.Info.UpvertedFiles()[0].Path
+	return me.FilePaths()[0]
+}
+
+// The paths of the files in the upload, relative to the upload's data directory. Replica uploads
+// have historically put the file under a directory named for the prefix, but standard single-file
+// torrents use the info name as the file name.
+func (me UploadMetainfo) FilePaths() (ret [][]string) {
+	if !me.Info.IsDir() {
+		return [][]string{{me.Info.BestName()}}
+	}
+	for _, fi := range me.Info.UpvertedFiles() {
+		ret = append(ret, fi.BestPath())
+	}
+	return
+}
+
+func (me UploadMetainfo) IsMultiFile() bool {
+	return len(me.Info.UpvertedFiles()) > 1
 }
 
 type IteredUpload struct {
@@ -160,4 +175,8 @@ type UploadOutput struct {
 	UploadMetainfo
 	AuthToken *string
 	Link      *string
+	// The info was checked against the bytes that were uploaded. Uploads that fail verification are
+	// returned with an error wrapping ErrUploadInfoMismatch. This can be false if the service hashed
+	// with an unexpected piece length.
+	Verified bool
 }
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The piece length the service is expected to hash uploads with, if ServiceClient.UploadPieceLength
+// isn't set.
+const DefaultUploadPieceLength = 1 << 18
+
+// The metainfo returned for an upload doesn't describe the data that was uploaded.
+var ErrUploadInfoMismatch = errors.New("upload info doesn't match uploaded data")
+
+// The upload info has a different piece length to the one the data was hashed with, so the pieces
+// can't be compared.
+var ErrUnverifiablePieceLength = errors.New("upload info piece length differs from local hashing")
+
+// PieceHasher computes BitTorrent v1 piece hashes for the data written to it.
+type PieceHasher struct {
+	pieceLength int64
+	h           hash.Hash
+	// Bytes written to h for the current piece.
+	pieceBytes int64
+	pieces     []byte
+	length     int64
+}
+
+func NewPieceHasher(pieceLength int64) *PieceHasher {
+	return &PieceHasher{
+		pieceLength: pieceLength,
+		h:           sha1.New(),
+	}
+}
+
+func (me *PieceHasher) Write(b []byte) (n int, err error) {
+	for len(b) != 0 {
+		take := min(int64(len(b)), me.pieceLength-me.pieceBytes)
+		me.h.Write(b[:take])
+		me.pieceBytes += take
+		me.length += take
+		n += int(take)
+		b = b[take:]
+		if me.pieceBytes == me.pieceLength {
+			me.pieces = me.h.Sum(me.pieces)
+			me.h.Reset()
+			me.pieceBytes = 0
+		}
+	}
+	return
+}
+
+func (me *PieceHasher) PieceLength() int64 {
+	return me.pieceLength
+}
+
+// The concatenated piece hashes, including any partial final piece.
+func (me *PieceHasher) Pieces() []byte {
+	ret := slices.Clone(me.pieces)
+	if me.pieceBytes != 0 {
+		ret = me.h.Sum(ret)
+	}
+	return ret
+}
+
+// The total number of bytes written.
+func (me *PieceHasher) Length() int64 {
+	return me.length
+}
+
+// A file as it was sent for upload.
+type UploadedFile struct {
+	// May be empty if the file name was left to the service.
+	Path   []string
+	Length int64
+}
+
+// VerifyUploadInfo checks an info returned for an upload describes the given files, with pieces
+// hashed by hasher. Returns an error wrapping ErrUploadInfoMismatch if it doesn't, or
+// ErrUnverifiablePieceLength if everything checked out except for the pieces, which couldn't be
+// compared.
+func VerifyUploadInfo(info *metainfo.Info, files []UploadedFile, hasher *PieceHasher) error {
+	umi := UploadMetainfo{Info: *info}
+	infoPaths := umi.FilePaths()
+	infoFiles := info.UpvertedFiles()
+	if len(infoFiles) != len(files) {
+		return fmt.Errorf("%w: got %v files, expected %v", ErrUploadInfoMismatch, len(infoFiles), len(files))
+	}
+	for i, f := range files {
+		if len(f.Path) != 0 && f.Path[0] != "" && !slices.Equal(f.Path, infoPaths[i]) {
+			return fmt.Errorf("%w: file %v has path %q, expected %q", ErrUploadInfoMismatch, i, infoPaths[i], f.Path)
+		}
+		if infoFiles[i].Length != f.Length {
+			return fmt.Errorf("%w: file %v has length %v, expected %v", ErrUploadInfoMismatch, i, infoFiles[i].Length, f.Length)
+		}
+	}
+	if info.TotalLength() != hasher.Length() {
+		return fmt.Errorf("%w: total length %v, expected %v", ErrUploadInfoMismatch, info.TotalLength(), hasher.Length())
+	}
+	if info.PieceLength != hasher.PieceLength() {
+		return fmt.Errorf("%w: got %v, hashed with %v", ErrUnverifiablePieceLength, info.PieceLength, hasher.PieceLength())
+	}
+	if !bytes.Equal(info.Pieces, hasher.Pieces()) {
+		return fmt.Errorf("%w: pieces differ", ErrUploadInfoMismatch)
+	}
+	return nil
+}
+
+// Hashes upload content as it's read, so the service response can be checked. Content is hashed once,
+// with the piece length the service is expected to use.
+type uploadVerifier struct {
+	hasher *PieceHasher
+	files  []UploadedFile
+}
+
+func newUploadVerifier(pieceLength int64) *uploadVerifier {
+	return &uploadVerifier{hasher: NewPieceHasher(pieceLength)}
+}
+
+// Returns a reader that records everything read from r as the next file in the upload.
+func (me *uploadVerifier) addFile(path []string, r io.Reader) io.Reader {
+	i := len(me.files)
+	me.files = append(me.files, UploadedFile{Path: path})
+	return io.TeeReader(r, writerFunc(func(b []byte) (int, error) {
+		me.files[i].Length += int64(len(b))
+		return me.hasher.Write(b)
+	}))
+}
+
+// Rejects outputs that don't match what was read. The output is still returned with the error, so
+// the caller can decide what to do with the upload, like deleting it. Outputs that can't be fully
+// checked, like when the service used another piece length, are passed through with Verified unset.
+func (me *uploadVerifier) verify(output *UploadOutput) error {
+	err := VerifyUploadInfo(&output.Info, me.files, me.hasher)
+	if errors.Is(err, ErrUnverifiablePieceLength) {
+		log.Errorf("can't verify upload pieces: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	output.Verified = true
+	return nil
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (me readerFunc) Read(b []byte) (int, error) {
+	return me(b)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (me writerFunc) Write(b []byte) (int, error) {
+	return me(b)
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// What the fake services here hash uploads with.
+const testPieceLength = 1 << 18
+
+func TestPieceHasherMatchesGeneratePieces(t *testing.T) {
+	data := make([]byte, 3*testPieceLength+1234)
+	rand.Read(data)
+	info := metainfo.Info{Name: "file", PieceLength: testPieceLength, Length: int64(len(data))}
+	require.NoError(t, info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}))
+	hasher := NewPieceHasher(testPieceLength)
+	// Odd sized writes to cross piece boundaries.
+	for b := data; len(b) != 0; {
+		n := min(len(b), 1000)
+		hasher.Write(b[:n])
+		b = b[n:]
+	}
+	assert.Equal(t, info.Pieces, hasher.Pieces())
+	files := []UploadedFile{{Path: []string{"file"}, Length: int64(len(data))}}
+	assert.NoError(t, VerifyUploadInfo(&info, files, hasher))
+	files[0].Path = []string{"other"}
+	assert.ErrorIs(t, VerifyUploadInfo(&info, files, hasher), ErrUploadInfoMismatch)
+	files[0].Path = nil
+	info.PieceLength *= 2
+	assert.ErrorIs(t, VerifyUploadInfo(&info, files, hasher), ErrUnverifiablePieceLength)
+}
+
+// Serves uploads with metainfo made by info from the uploaded data, recording deletes.
+func newVerifyTestServer(t *testing.T, info func(data []byte) metainfo.Info) (cl ServiceClient, deleted *atomic.Bool) {
+	deleted = new(atomic.Bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/delete" {
+			deleted.Store(true)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		info := info(data)
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		json.NewEncoder(w).Encode(ServiceUploadOutput{
+			Link:       mi.Magnet(nil, &info).String() + "&xs=replica:prefix",
+			Metainfo:   JsonBinaryString{bencode.MustMarshal(mi)},
+			AdminToken: "token",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	cl = ServiceClient{
+		ReplicaServiceEndpoint: func() *url.URL { u, _ := url.Parse(srv.URL); return u },
+		HttpClient:             srv.Client(),
+	}
+	return
+}
+
+func generatedInfo(name string, pieceLength int64, data []byte) metainfo.Info {
+	info := metainfo.Info{Name: name, PieceLength: pieceLength, Length: int64(len(data))}
+	err := info.GeneratePieces(func(metainfo.FileInfo) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return info
+}
+
+func TestUploadRejectsMismatchedInfo(t *testing.T) {
+	cl, deleted := newVerifyTestServer(t, func([]byte) metainfo.Info {
+		// Metainfo for something else entirely.
+		return generatedInfo("file", testPieceLength, []byte("not what was uploaded"))
+	})
+	output, err := cl.Upload(bytes.NewReader([]byte("what was uploaded!!!!")), "file", UploadOptions{})
+	assert.ErrorIs(t, err, ErrUploadInfoMismatch)
+	// It's up to the caller what happens to the upload.
+	assert.False(t, deleted.Load())
+	require.NotNil(t, output.AuthToken)
+	assert.Equal(t, "token", *output.AuthToken)
+	assert.False(t, output.Verified)
+}
+
+func TestUploadVerifiedWithServicePieceLength(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	for _, pieceLength := range []int64{16 << 10, DefaultUploadPieceLength, 16 << 20} {
+		cl, _ := newVerifyTestServer(t, func(data []byte) metainfo.Info {
+			return generatedInfo("file", pieceLength, data)
+		})
+		if pieceLength != DefaultUploadPieceLength {
+			cl.UploadPieceLength = pieceLength
+		}
+		output, err := cl.Upload(bytes.NewReader(data), "file", UploadOptions{})
+		require.NoError(t, err)
+		assert.True(t, output.Verified, pieceLength)
+	}
+	// Lengths are still checked, but the pieces can't be.
+	cl, _ := newVerifyTestServer(t, func(data []byte) metainfo.Info {
+		return generatedInfo("file", 1<<20, data)
+	})
+	output, err := cl.Upload(bytes.NewReader(data), "file", UploadOptions{})
+	require.NoError(t, err)
+	assert.False(t, output.Verified)
+}